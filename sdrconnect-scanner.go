@@ -7,24 +7,39 @@
 package main
 
 import (
+	"bufio"
+	"cmp"
+	"database/sql"
 	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"math"
 	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/eiannone/keyboard"
 	"golang.org/x/net/websocket"
 	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+	_ "modernc.org/sqlite"
 )
 
 type Message struct {
@@ -90,6 +105,18 @@ func ParseDemodulatorMode(dmstring string) (DemodulatorMode, error) {
 	}
 }
 
+// repeatable command line flag
+type StringList []string
+
+func (sl *StringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *StringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
 type LOSpan struct {
 	from      int
 	to        int
@@ -97,29 +124,112 @@ type LOSpan struct {
 }
 
 type Scan struct {
+	Name                 string
 	Start                uint64
 	Stop                 uint64
 	Step                 int64
 	List                 []uint64
+	ListCommand          string
+	ListCommandRefresh   bool
+	ListLabels           map[uint64]string
+	Order                string
+	Snap                 uint64
+	DedupFrequencies     bool
+	ManualStep           bool
+	Mode                 string
+	DigitalProperties    []string
+	DisplayUnit          string
+	DisplayPrecision     int
 	DeviceName           string
 	DeviceSerial         string
+	DeviceSelectRetries  uint32
 	Profile              string
+	OnInitError          string
+	DemodulatorMismatch  string
 	DetectPowerThreshold float64
 	DetectSNRThreshold   float64
-	DetectTime           time.Duration
-	ListenTime           time.Duration
-	ListenExtraTimeRDS   time.Duration
-	LOOffset             int32
-	LOSpans              []LOSpan
+	// per demodulator mode overrides of the detect thresholds
+	DetectPowerThresholds  map[DemodulatorMode]float64
+	DetectSNRThresholds    map[DemodulatorMode]float64
+	DetectPowerMode        string
+	DetectTime             time.Duration
+	DetectSmoothingAlpha   float64
+	DetectSingleSample     bool
+	DetectPowerFloorSet    bool
+	DetectPowerFloor       float64
+	DetectStereoPilot      bool
+	DetectMinRDSRate       float64
+	DetectRequireRDS       bool
+	DetectRequireRDSTime   time.Duration
+	CalibrateFrequency     uint64
+	CalibrateMargin        float64
+	CalibrateTime          time.Duration
+	Calibrated             bool
+	ListenTime             time.Duration
+	ListenTimes            map[uint64]time.Duration
+	ListenExtraTimeRDS     time.Duration
+	MaxListenTime          time.Duration
+	ListenTimeMin          time.Duration
+	ListenTimeMax          time.Duration
+	DetectionAgingTime     time.Duration
+	DetectionRateLimit     time.Duration
+	StatsWindow            int
+	WarmupTime             time.Duration
+	SkipRDSPI              []uint16
+	RDSDominantPI          bool
+	StopOnFirst            string
+	ResumeAfterHold        string
+	DetectMode             string
+	DetectFallback         string
+	ConfirmOnListen        bool
+	PostListenCooldown     time.Duration
+	StepDelay              time.Duration
+	FineSearch             uint32
+	RejectSpurs            bool
+	FineSearchSteps        uint32
+	CWKeyingDetection      bool
+	LOOffset               int32
+	LOOffsetPercent        float64
+	LOSpans                []LOSpan
+	LOSpansFilterBandwidth uint32
+	IFBandwidthskHz        []uint32
+	MinSpanFrequencies     uint32
+	CenterHold             bool
+	RetunesSaved           int
+	ResumeFrequency        uint64
+	CurrentFrequency       uint64
+	Timing                 TimingProfile
+	OccupancyFile          string
+	MergeDetectionsWithin  uint64
+	Occupancy              map[uint64]*OccupancyCount
+	DetectAbsence          bool
+	Active                 map[uint64]bool
+	DetectionDeltas        bool
+	Deltas                 map[uint64]string
+	Output                 string
+	OutputOnly             bool
+	OutputWriter           *csv.Writer
 	// SDRconnect properties
-	SampleRate       float64
-	Demodulator      DemodulatorMode
-	LNAStateSet      bool
-	LNAState         uint32
-	SquelchEnable    bool
-	SquelchThreshold float64
-	AGCEnable        bool
-	AGCThreshold     float64
+	SampleRate        float64
+	SampleRateOptions []float64
+	// the sample rate options rejected by the device are not tried again
+	RejectedSampleRates map[float64]bool
+	Demodulator         DemodulatorMode
+	LNAStateSet         bool
+	LNAState            uint32
+	LNAStateAuto        bool
+	Antenna             string
+	BiasTeeSet          bool
+	BiasTee             bool
+	SquelchEnable       bool
+	SquelchThreshold    float64
+	AGCEnable           bool
+	AGCThreshold        float64
+	MuteDuringDetect    bool
+	AutoPauseOnDetect   bool
+	ListenSquelch       string
+	SetProperties       []PropertyValue
+	ForceSettings       bool
 }
 
 type SDRconnectSettings struct {
@@ -133,44 +243,277 @@ type SDRconnectSettings struct {
 	// SDRconnect properties
 	Demodulator      DemodulatorMode
 	LNAState         uint32
+	LNAStateAuto     bool
+	Antenna          string
+	BiasTeeKnown     bool
+	BiasTee          bool
 	SquelchEnable    bool
 	SquelchThreshold float64
 	AGCEnable        bool
 	AGCThreshold     float64
+	AudioMute        bool
+	// properties set with 'set property'
+	Properties map[string]string
+}
+
+// JSON outputs
+// each record has a schema_version field; the version is bumped whenever
+// the format of the record changes, and the struct for each version is
+// documented here
+//
+// ScanPlan schema versions:
+//   - 1: initial version
+const scanPlanSchemaVersion = 1
+
+// DetectionEvent schema versions:
+//   - 1: initial version
+const detectionEventSchemaVersion = 1
+
+// CalibrationCache schema versions:
+//   - 1: initial version
+const calibrationCacheSchemaVersion = 1
+
+// the calibration cache entries are keyed by device and profile, so the
+// learned values are not used anymore when the device or profile changes
+type CalibrationCache struct {
+	SchemaVersion int                               `json:"schema_version"`
+	Entries       map[string]*CalibrationCacheEntry `json:"entries"`
+}
+
+type CalibrationCacheEntry struct {
+	Waits      map[string]time.Duration        `json:"waits,omitempty"`
+	Thresholds map[string]CalibratedThresholds `json:"thresholds,omitempty"`
+}
+
+type CalibratedThresholds struct {
+	DetectPowerThreshold float64 `json:"detect_power_threshold"`
+	DetectSNRThreshold   float64 `json:"detect_snr_threshold"`
+}
+
+type DetectionEvent struct {
+	SchemaVersion int      `json:"schema_version"`
+	Timestamp     string   `json:"timestamp"`
+	Scan          string   `json:"scan"`
+	Frequency     uint64   `json:"frequency"`
+	Power         *float64 `json:"power,omitempty"`
+	SNR           *float64 `json:"snr,omitempty"`
+	RDSPI         string   `json:"rds_pi,omitempty"`
+	RDSPS         string   `json:"rds_ps,omitempty"`
+	Labels        []string `json:"labels,omitempty"`
+	Demodulator   string   `json:"demodulator"`
+}
+
+type ScanPlan struct {
+	SchemaVersion        int                 `json:"schema_version"`
+	Start                uint64              `json:"start,omitempty"`
+	Stop                 uint64              `json:"stop,omitempty"`
+	Step                 int64               `json:"step,omitempty"`
+	List                 []uint64            `json:"list,omitempty"`
+	DeviceName           string              `json:"device_name,omitempty"`
+	DeviceSerial         string              `json:"device_serial,omitempty"`
+	Profile              string              `json:"profile,omitempty"`
+	DetectPowerThreshold float64             `json:"detect_power_threshold"`
+	DetectSNRThreshold   float64             `json:"detect_snr_threshold"`
+	DetectTimeMs         int64               `json:"detect_time_ms"`
+	ListenTimeMs         int64               `json:"listen_time_ms"`
+	SampleRate           float64             `json:"sample_rate"`
+	FilterBandwidth      uint32              `json:"filter_bandwidth"`
+	IFBandwidth          uint32              `json:"if_bandwidth"`
+	LOOffset             int32               `json:"lo_offset"`
+	Demodulator          string              `json:"demodulator,omitempty"`
+	LOSpans              []ScanPlanLOSpan    `json:"lo_spans"`
+	Frequencies          []ScanPlanFrequency `json:"frequencies"`
+}
+
+type ScanPlanLOSpan struct {
+	From            int    `json:"from"`
+	To              int    `json:"to"`
+	CenterFrequency uint64 `json:"center_frequency"`
+}
+
+type ScanPlanFrequency struct {
+	Frequency       uint64 `json:"frequency"`
+	CenterFrequency uint64 `json:"center_frequency"`
+}
+
+type LatencyTracker struct {
+	name       string
+	wait       *time.Duration
+	count      int
+	maxLatency time.Duration
+}
+
+// global settings from the default section of the configuration file
+// they are staged while the configuration file is read, and applied only
+// once the whole file is valid
+type GlobalSettings struct {
+	topStations      int
+	scorePowerWeight float64
+	scoreSNRWeight   float64
+	scoreRDSWeight   float64
+	verifySets       bool
+	labelTolerance   uint64
+	waits            map[*time.Duration]time.Duration
+	reconnectResync  string
+	keyActions       map[rune]string
+	cycleDelay       time.Duration
+	onStartScript    string
+	onStopScript     string
+}
+
+// output throttling
+// the low priority lines over the max lines per second are dropped, and
+// the number of dropped lines is shown when the output resumes
+type ThrottledWriter struct {
+	w           io.Writer
+	maxLines    int
+	windowStart time.Time
+	lines       int
+	dropped     int
+	mu          sync.Mutex
+}
+
+// the priority lines (detections, warnings, and errors) are written
+// through a PriorityWriter, so they are never dropped
+type PriorityWriter struct {
+	tw *ThrottledWriter
+}
+
+type PropertyValue struct {
+	property string
+	value    string
 }
 
 type FrequencyAndIndex struct {
-	frequency uint64
-	index     int
+	frequency  uint64
+	index      int
+	listenTime time.Duration
 }
 
 type FrequencyAndLOFrequency struct {
 	frequency   uint64
 	loFrequency uint64
+	listenTime  time.Duration
+	// start of a new LO span (the LO frequency is set only if the
+	// center frequency has to change)
+	spanStart bool
+}
+
+type OccupancyCount struct {
+	detections int
+	passes     int
+}
+
+type Detection struct {
+	scan        *Scan
+	time        time.Time
+	frequency   uint64
+	labels      []string
+	signalPower float64
+	signalSNR   float64
+	rdsPI       uint16
+	rdsPS       string
+	score       float64
+}
+
+type ReportEntry struct {
+	frequency   uint64
+	labels      []string
+	count       int
+	firstSeen   time.Time
+	lastSeen    time.Time
+	signalPower float64
+	signalSNR   float64
+	rdsPI       uint16
+	rdsPS       string
+}
+
+// time spent in each phase of a scan
+type TimingProfile struct {
+	init        time.Duration
+	retune      time.Duration
+	detect      time.Duration
+	listen      time.Duration
+	retunes     int
+	frequencies int
+	listens     int
+}
+
+type TrackedDetection struct {
+	lastSeen time.Time
+	rdsPI    uint16
+	// aging time of the scan that detected the frequency last
+	agingTime time.Duration
 }
 
 type ReceiveStats struct {
-	countMessages int
-	signalPower   []float64
-	signalSNR     []float64
-	rdsPI         []uint16
-	rdsPS         []string
+	countMessages   int
+	signalPower     []float64
+	signalPowerTime []time.Time
+	signalSNR       []float64
+	rdsPI           []uint16
+	rdsPS           []string
+	rdsPSPI         []uint16
+	rdsTime         []time.Time
+	stereoPilot     bool
+	squelchOpen     bool
+	detectTrigger   string
 }
 
 // global variables
 var ws *websocket.Conn
 var defaultSection *ini.Section
 var labels = make(map[uint64]string)
+var labelFrequencies []uint64
+var labelTolerance uint64
+var trackedDetections = make(map[uint64]*TrackedDetection)
+var lastLoggedDetections = make(map[uint64]time.Time)
+
+// detections in the current cycle
+var cycleDetections []Detection
+
+// ranking of the detections in each cycle
+var topStations int
+var scorePowerWeight = 1.0
+var scoreSNRWeight = 1.0
+var scoreRDSWeight = 10.0
+
+// database
+var db *sql.DB
+var dbTx *sql.Tx
+var dbTxStart time.Time
+var dbTxRows int
+var dbInsert *sql.Stmt
+var dbCommitRows = 100
+var dbCommitInterval = 10 * time.Second
+
+// report
+var reportFile string
+var reportStart time.Time
+var reportScanNames []string
+var reportEntries = make(map[string]map[uint64]*ReportEntry)
+
+// MQTT
+var mqttClient mqtt.Client
+var mqttTopic string
 var sdrconnectSettings = SDRconnectSettings{}
 var maxStats = 100
+
+// minimum difference (in dB) between key down and key up signal power
+var cwKeyingMinDepth = 10.0
 var receiveStats = ReceiveStats{
-	signalPower: make([]float64, 0, maxStats),
-	signalSNR:   make([]float64, 0, maxStats),
-	rdsPI:       make([]uint16, 0, maxStats),
-	rdsPS:       make([]string, 0, maxStats),
+	signalPower:     make([]float64, 0, maxStats),
+	signalPowerTime: make([]time.Time, 0, maxStats),
+	signalSNR:       make([]float64, 0, maxStats),
+	rdsPI:           make([]uint16, 0, maxStats),
+	rdsPS:           make([]string, 0, maxStats),
+	rdsPSPI:         make([]uint16, 0, maxStats),
+	rdsTime:         make([]time.Time, 0, maxStats),
 }
 
 var debug bool
+var verbose bool
+var timingProfile bool
 
 // wait times
 var waitGetProperty = 1000 * time.Millisecond
@@ -180,6 +523,26 @@ var waitApplyProfile = 600 * time.Millisecond
 var waitSetCenterFrequency = 1000 * time.Millisecond
 var waitSignalPowerAndSNR = 600 * time.Millisecond
 
+// adaptive waits
+var adaptiveWaits bool
+var adaptiveWaitSamples = 10
+var adaptiveWaitMargin = 3
+var adaptiveWaitMin = 200 * time.Millisecond
+var setPropertyLatency = LatencyTracker{name: "set property", wait: &waitSetProperty}
+var setCenterFrequencyLatency = LatencyTracker{name: "set center frequency", wait: &waitSetCenterFrequency}
+var setVFOFrequencyLatency = LatencyTracker{name: "set VFO frequency"}
+var lastVFOFrequencyChange time.Time
+
+// output throttling (the priority lines are never dropped)
+var priorityLog = log.Default()
+
+// calibration cache
+var calibrationCacheFile string
+var calibrationCache = CalibrationCache{Entries: make(map[string]*CalibrationCacheEntry)}
+
+// detections are ignored until this time
+var warmupUntil time.Time
+
 var defaultDetectTime = waitSignalPowerAndSNR
 var defaultListenTime = 5 * time.Second
 
@@ -191,60 +554,264 @@ var userCommandTerminate bool
 // custom errors to pass user commands
 var ErrUserCommandNextScan = errors.New("user command nextscan")
 var ErrUserCommandTerminate = errors.New("user command terminate")
+var ErrUserCommandStep = errors.New("user command step")
+var ErrUserCommandJump = errors.New("user command jump")
+
+// key to user command table (Ctrl-C always terminates)
+var defaultKeyActions = map[rune]string{
+	'q': "terminate",
+	'Q': "terminate",
+	' ': "pause",
+	'n': "next",
+	'N': "next",
+	'l': "lockout",
+	'L': "lockout",
+	'f': "forward",
+	'b': "back",
+	'g': "jump",
+	'G': "jump",
+}
+var keyActions = defaultKeyActions
+
+// frequencies locked out by the user for this session
+var lockedOutFrequencies = make(map[uint64]bool)
+var userCommandLockout bool
+
+// manual step mode
+var manualStep bool
+var userCommandStep int
+
+// frequency jump (only while a scan is running)
+var scanning bool
+var userCommandJump uint64
+
+// session settings
+var cycleDelay time.Duration
+var verifySets bool
+var deviceSelectUnverifiable bool
+var reconnectResync string
+var onStartScript string
+var onStopScript string
+var onStopOnce sync.Once
+var sessionScriptEnv []string
+
+// protocol errors
+var ErrWebsocketClosed = errors.New("websocket closed")
+var ErrPropertyRejected = errors.New("property rejected")
+var ErrTimeout = errors.New("timeout")
 
 func main() {
 	var wsAddress string
 	flag.StringVar(&wsAddress, "ws", "127.0.0.1:5454", "SDRconnect web socket address (IP:port)")
-	var configFile string
-	flag.StringVar(&configFile, "conf", "", "scanner configuration file")
+	var configFiles StringList
+	flag.Var(&configFiles, "conf", "scanner configuration file (repeatable; later files override earlier ones)")
 	var labelFile string
 	flag.StringVar(&labelFile, "labels", "", "CSV file with labels")
+	var dumpLabels bool
+	flag.BoolVar(&dumpLabels, "dump-labels", false, "print the labels read from the labels file and exit")
 	flag.BoolVar(&debug, "debug", false, "enable debug")
+	flag.BoolVar(&timingProfile, "timing", false, "show how much time each scan spent retuning, detecting, and listening")
+	flag.BoolVar(&verbose, "verbose", false, "show the center frequency and the IF offset of each detection")
+	flag.BoolVar(&adaptiveWaits, "adaptive-waits", false, "shorten the wait times based on the measured SDRconnect latency")
+	flag.StringVar(&calibrationCacheFile, "calibration-cache", "", "file where the adaptive waits and the calibrated thresholds are saved on exit and loaded at startup")
+	var once bool
+	flag.BoolVar(&once, "once", false, "run all the scans only once and exit")
+	var dbFile string
+	flag.StringVar(&dbFile, "db", "", "SQLite database file where detections are stored")
+	var mqttBroker string
+	flag.StringVar(&mqttBroker, "mqtt", "", "MQTT broker where detections are published (e.g. tcp://127.0.0.1:1883)")
+	flag.StringVar(&mqttTopic, "mqtt-topic", "sdrscanner/{scan}/{frequency}", "MQTT topic for the detections")
+	var planFile string
+	flag.StringVar(&planFile, "plan-json", "", "write the scan plan as JSON to this file and exit")
+	var planSampleRate float64
+	flag.Float64Var(&planSampleRate, "plan-sample-rate", 0, "sample rate for the scan plan (default: from SDRconnect)")
+	var planFilterBandwidth uint
+	flag.UintVar(&planFilterBandwidth, "plan-filter-bandwidth", 0, "filter bandwidth for the scan plan (default: from SDRconnect)")
+	var getProperty string
+	flag.StringVar(&getProperty, "get", "", "print the value of this SDRconnect property and exit")
+	var setProperty string
+	flag.StringVar(&setProperty, "set", "", "set an SDRconnect property (property=value), print the actual value, and exit")
+	flag.StringVar(&reportFile, "report", "", "write a summary report of all the detections to this file on exit")
+	var reportEachCycle bool
+	flag.BoolVar(&reportEachCycle, "report-each-cycle", false, "also update the report file at the end of each cycle")
+	flag.StringVar(&spectrogramDir, "spectrogram", "", "directory where a spectrogram PNG image of each scan is written at the end of each cycle")
+	var selfTest bool
+	flag.BoolVar(&selfTest, "selftest", false, "check the protocol round-trip with SDRconnect, report pass/fail for each step, and exit")
+	var maxLinesPerSec int
+	flag.IntVar(&maxLinesPerSec, "max-lines-per-sec", 0, "max number of log lines per second (detections are always shown; default: no limit)")
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	if maxLinesPerSec > 0 {
+		tw := &ThrottledWriter{w: os.Stderr, maxLines: maxLinesPerSec}
+		log.SetOutput(tw)
+		priorityLog = log.New(&PriorityWriter{tw: tw}, "", log.Flags())
+	}
+
+	if dumpLabels {
+		if labelFile == "" {
+			priorityLog.Fatal("missing labels file")
+		}
+		err := readLabelFile(labelFile)
+		if err != nil {
+			priorityLog.Fatal("error reading label file: ", err)
+		}
+		dumpLabelMap()
+		return
+	}
+
+	if selfTest {
+		if !runSelfTest(wsAddress) {
+			os.Exit(1)
+		}
+		return
+	}
 
-	if configFile == "" {
-		log.Fatal("missing configuration file")
+	if getProperty != "" || setProperty != "" {
+		// the connection is closed before exiting with an error
+		err := runGetSetProperty(wsAddress, getProperty, setProperty)
+		if err != nil {
+			priorityLog.Fatal(err)
+		}
+		return
+	}
+
+	if len(configFiles) == 0 {
+		priorityLog.Fatal("missing configuration file")
 	}
 
-	scans, err := readConfigFile(configFile)
+	scans, err := readConfigFile(configFiles)
 	if err != nil {
-		log.Fatal("error reading configuration file: ", err)
+		priorityLog.Fatal("error reading configuration file: ", err)
 	}
 
 	if labelFile != "" {
 		err = readLabelFile(labelFile)
 		if err != nil {
-			log.Fatal("error reading label file: ", err)
+			priorityLog.Fatal("error reading label file: ", err)
 		}
 	}
+	for idx := range scans {
+		addListLabels(&scans[idx])
+	}
 
-	wsIp := strings.Split(wsAddress, ":")[0]
-	origin := fmt.Sprintf("http://%s/", wsIp)
-	url := fmt.Sprintf("ws://%s/", wsAddress)
-	ws, err = websocket.Dial(url, "", origin)
+	if spectrogramDir != "" {
+		err = os.MkdirAll(spectrogramDir, 0755)
+		if err != nil {
+			priorityLog.Fatal("error creating spectrogram directory: ", err)
+		}
+	}
+
+	if calibrationCacheFile != "" {
+		err = loadCalibrationCache(scans)
+		if err != nil {
+			priorityLog.Fatal("error reading calibration cache: ", err)
+		}
+		defer func() {
+			if err := saveCalibrationCache(scans); err != nil {
+				priorityLog.Println("error writing calibration cache:", err)
+			}
+		}()
+	}
+
+	if dbFile != "" {
+		err = openDatabase(dbFile)
+		if err != nil {
+			priorityLog.Fatal("error opening database: ", err)
+		}
+		defer closeDatabase()
+	}
+
+	if mqttBroker != "" {
+		connectMQTT(mqttBroker)
+		defer mqttClient.Disconnect(250)
+	}
+
+	if planFile != "" && planSampleRate != 0 && planFilterBandwidth != 0 {
+		err = writeScanPlan(scans, planFile, planSampleRate, uint32(planFilterBandwidth))
+		if err != nil {
+			priorityLog.Fatal("error writing scan plan: ", err)
+		}
+		return
+	}
+
+	err = connectSdrconnect(wsAddress)
 	if err != nil {
-		log.Fatal(err)
+		priorityLog.Fatal(err)
+	}
+	// the websocket is replaced when reconnecting
+	defer func() { ws.Close() }()
+
+	sessionScriptEnv = []string{
+		"SDRCONNECT_SCANNER_WS=" + wsAddress,
+		"SDRCONNECT_SCANNER_CONF=" + configFiles.String(),
+	}
+	if onStartScript != "" {
+		err = runSessionScript(onStartScript, "start")
+		if err != nil {
+			priorityLog.Fatal("error running 'on start' script: ", err)
+		}
+	}
+	defer runOnStopScript()
+
+	if planFile != "" {
+		// get the missing sample rate and/or filter bandwidth from SDRconnect
+		var settings SDRconnectSettings
+		settings, err = getSdrconnectSettings()
+		if err != nil {
+			fatal(err)
+		}
+		if planSampleRate == 0 {
+			planSampleRate = settings.SampleRate
+		}
+		if planFilterBandwidth == 0 {
+			planFilterBandwidth = uint(settings.FilterBandwidth)
+		}
+		err = writeScanPlan(scans, planFile, planSampleRate, uint32(planFilterBandwidth))
+		if err != nil {
+			fatal("error writing scan plan: ", err)
+		}
+		return
 	}
-	defer ws.Close()
 
 	if err = keyboard.Open(); err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	defer keyboard.Close()
 	go getKeyPresses()
 
 	sdrconnectSettings, err = getSdrconnectSettings()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	originalSettings := sdrconnectSettings
 	defer restoreSdrconnectSettings(originalSettings)
 
+	if reportFile != "" {
+		reportStart = time.Now()
+		defer func() {
+			if err := writeReport(); err != nil {
+				priorityLog.Println("error writing report:", err)
+			}
+		}()
+	}
+
+	// SIGHUP reloads the configuration file(s) at the start of the next cycle
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+
 	// main scan loop
 	waitingLogged := false
 	for {
+		select {
+		case <-reloadSignal:
+			reloadConfigFile(configFiles, &scans)
+		default:
+		}
+		cycleCompleted := true
+		if cycleDelay > 0 || debug {
+			log.Println("cycle started")
+		}
 		for idx := range scans {
 			scan := &scans[idx]
 			err = initScan(scan)
@@ -261,13 +828,32 @@ func main() {
 						waitingLogged = true
 					}
 					time.Sleep(5 * time.Second)
+					cycleCompleted = false
+					break
+				} else if errors.Is(err, ErrWebsocketClosed) && reconnectResync != "" {
+					err = reconnectSdrconnect(wsAddress)
+					if err != nil {
+						return
+					}
+					cycleCompleted = false
 					break
+				} else if scan.OnInitError == "skip" {
+					priorityLog.Println("init scan error - skipping scan:", err)
+					err = nil
+					continue
 				} else {
-					log.Println("init scan error:", err)
+					priorityLog.Println("init scan error:", err)
 					return
 				}
 			}
 			err = runScan(scan)
+			// after a frequency jump the scan resumes where it was
+			for errors.Is(err, ErrUserCommandJump) {
+				err = jumpToFrequency(scan)
+				if err == nil {
+					err = runScan(scan)
+				}
+			}
 			if err != nil {
 				if errors.Is(err, ErrUserCommandTerminate) {
 					err = nil
@@ -281,961 +867,4588 @@ func main() {
 						waitingLogged = true
 					}
 					time.Sleep(5 * time.Second)
+					cycleCompleted = false
+					break
+				} else if errors.Is(err, ErrWebsocketClosed) && reconnectResync != "" {
+					err = reconnectSdrconnect(wsAddress)
+					if err != nil {
+						return
+					}
+					cycleCompleted = false
 					break
 				} else {
-					log.Println("scan error:", err)
+					priorityLog.Println("scan error:", err)
 					return
 				}
 			}
 			waitingLogged = false
 		}
-	}
-}
-
-func readConfigFile(configFile string) (scans []Scan, err error) {
-	config, err := ini.LoadSources(
-		ini.LoadOptions{
-			AllowNonUniqueSections: true,
-		},
-		configFile,
-	)
-	if err != nil {
-		return nil, err
-	}
-	config.BlockMode = false
-	defaultSection, err = config.GetSection("")
-	if err != nil {
-		return nil, err
-	}
-
-	scanSections, err := config.SectionsByName("scan")
-	if err != nil {
-		return nil, err
-	}
-
-	for _, section := range scanSections {
-
-		hasRange := section.HasKey("range")
-		hasList := section.HasKey("list")
-		if (!hasRange && !hasList) || (hasRange && hasList) {
-			err := fmt.Errorf("scan section should have a 'range' or 'list' setting (but not both)")
-			return nil, err
+		if topStations > 0 {
+			showTopStations()
 		}
-
-		var freqStart uint64
-		var freqStop uint64
-		var freqStep int64
-		var freqList []uint64
-		if hasRange {
-			freqRangeValues := section.Key("range").Float64s(",")
-			if len(freqRangeValues) != 3 {
-				err := fmt.Errorf("range setting must have exactly three values")
-				return nil, err
-			}
-			if freqRangeValues[2] == 0 {
-				err := fmt.Errorf("range setting step value must not be 0")
-				return nil, err
-			}
-			if freqRangeValues[2] > 0 && !(freqRangeValues[1] > freqRangeValues[0]) {
-				err := fmt.Errorf("range setting end value must be greater than start value")
-				return nil, err
-			}
-			if freqRangeValues[2] < 0 && !(freqRangeValues[1] < freqRangeValues[0]) {
-				err := fmt.Errorf("range setting end value must be less than start value (negative step)")
-				return nil, err
-			}
-			freqStart = uint64(freqRangeValues[0])
-			freqStop = uint64(freqRangeValues[1])
-			freqStep = int64(freqRangeValues[2])
-		} else if hasList {
-			freqListValues := section.Key("list").Float64s(",")
-			if len(freqListValues) == 0 {
-				err := fmt.Errorf("invalid frequency scan list")
-				return nil, err
+		if cycleCompleted {
+			for idx := range scans {
+				adaptListenTime(&scans[idx])
 			}
-			freqList = make([]uint64, 0, len(freqListValues))
-			for _, f := range freqListValues {
-				freqList = append(freqList, uint64(f))
+		}
+		cycleDetections = cycleDetections[:0]
+		if spectrogramDir != "" {
+			if err := writeSpectrograms(); err != nil {
+				priorityLog.Println("error writing spectrograms:", err)
 			}
 		}
-
-		deviceName, ok, err := getStringConfigSetting("device name", section)
-		if err != nil {
-			return nil, err
+		if reportFile != "" && reportEachCycle {
+			if err := writeReport(); err != nil {
+				priorityLog.Println("error writing report:", err)
+			}
 		}
-		deviceSerial, ok, err := getStringConfigSetting("device serial", section)
-		if err != nil {
-			return nil, err
+		if cycleDelay > 0 || debug {
+			log.Println("cycle ended")
 		}
-		if deviceName != "" && deviceSerial != "" {
-			err = fmt.Errorf("select only one of 'device name' or 'device serial'")
-			return nil, err
+		if once && cycleCompleted {
+			return
 		}
-		profile, ok, err := getStringConfigSetting("profile", section)
-		if err != nil {
-			return nil, err
+		if cycleDelay > 0 && cycleCompleted {
+			// keep reading the messages from SDRconnect while waiting,
+			// so the user commands are handled and nothing piles up
+			clearReceiveStats()
+			err = receiveMessages(&sdrconnectSettings, "cycle delay", nil, cycleDelay)
+			if errors.Is(err, ErrUserCommandTerminate) {
+				err = nil
+				return
+			}
+			err = nil
 		}
+	}
+}
 
-		detectPowerThreshold, ok, err := getFloat64ConfigSetting("detect power threshold", section)
-		if err != nil {
-			return nil, err
+// reloadConfigFile replaces the scans with the ones in the configuration
+// file(s); the cached SDRconnect settings (including the selected device
+// and profile) are kept, so initScan doesn't select the same device or
+// apply the same profile again
+func reloadConfigFile(configFiles []string, scans *[]Scan) {
+	reloadedScans, err := readConfigFile(configFiles)
+	if err != nil {
+		priorityLog.Println("error reloading configuration file - keeping the current configuration:", err)
+		return
+	}
+	// the scans that keep their name keep their runtime state too
+	for idx := range reloadedScans {
+		reloadedScan := &reloadedScans[idx]
+		scanIdx := slices.IndexFunc(*scans, func(scan Scan) bool { return scan.Name == reloadedScan.Name })
+		if scanIdx < 0 {
+			continue
 		}
-		detectSNRThreshold, ok, err := getFloat64ConfigSetting("detect snr threshold", section)
-		if err != nil {
-			return nil, err
+		scan := &(*scans)[scanIdx]
+		reloadedScan.Occupancy = scan.Occupancy
+		reloadedScan.Active = scan.Active
+		reloadedScan.Deltas = scan.Deltas
+		reloadedScan.ResumeFrequency = scan.ResumeFrequency
+		if reloadedScan.Output == scan.Output {
+			reloadedScan.OutputWriter = scan.OutputWriter
 		}
-		detectTimeMs, ok, err := getUint32ConfigSetting("detect time", section)
+	}
+	*scans = reloadedScans
+	for idx := range *scans {
+		addListLabels(&(*scans)[idx])
+	}
+	if calibrationCacheFile != "" {
+		err = loadCalibrationCache(*scans)
 		if err != nil {
-			return nil, err
+			priorityLog.Println("error reading calibration cache:", err)
 		}
-		detectTime := defaultDetectTime
-		if ok {
-			detectTime = time.Duration(detectTimeMs) * time.Millisecond
-			if detectTime < waitSignalPowerAndSNR {
-				err = fmt.Errorf("detect time should be at least %v", waitSignalPowerAndSNR)
-				return nil, err
+	}
+	// the spectrograms belong to the old scans
+	clear(spectrograms)
+	log.Println("configuration reloaded")
+}
+
+// structured (JSON or YAML) configuration file; the settings have the
+// same names as in the INI file, for instance:
+//
+//	{"default": {"detect time": 700}, "scans": [{"list": [100e6, 101e6]}]}
+type StructuredConfig struct {
+	Default map[string]any   `json:"default" yaml:"default"`
+	Scans   []map[string]any `json:"scans" yaml:"scans"`
+}
+
+func convertStructuredConfigFile(configFile string) (source []byte, err error) {
+	var data []byte
+	data, err = os.ReadFile(configFile)
+	if err != nil {
+		return
+	}
+	var structuredConfig StructuredConfig
+	if strings.ToLower(filepath.Ext(configFile)) == ".json" {
+		err = json.Unmarshal(data, &structuredConfig)
+	} else {
+		err = yaml.Unmarshal(data, &structuredConfig)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: %w", configFile, err)
+		return
+	}
+	var sb strings.Builder
+	writeSettings := func(settings map[string]any) (err error) {
+		for _, name := range slices.Sorted(maps.Keys(settings)) {
+			var value string
+			value, err = formatStructuredConfigValue(settings[name])
+			if err != nil {
+				err = fmt.Errorf("%s: setting '%s': %w", configFile, name, err)
+				return
 			}
+			// values are quoted with backticks, so they are taken literally
+			fmt.Fprintf(&sb, "%s = `%s`\n", name, value)
 		}
-		listenTimeMs, ok, err := getUint32ConfigSetting("listen time", section)
-		if err != nil {
+		return
+	}
+	err = writeSettings(structuredConfig.Default)
+	if err != nil {
+		return
+	}
+	for _, scan := range structuredConfig.Scans {
+		sb.WriteString("[scan]\n")
+		err = writeSettings(scan)
+		if err != nil {
+			return
+		}
+	}
+	source = []byte(sb.String())
+	return
+}
+
+func formatStructuredConfigValue(value any) (result string, err error) {
+	switch v := value.(type) {
+	case string:
+		result = v
+	case bool:
+		result = strconv.FormatBool(v)
+	case int:
+		result = strconv.Itoa(v)
+	case float64:
+		result = strconv.FormatFloat(v, 'f', -1, 64)
+	case []any:
+		var values []string
+		for _, element := range v {
+			var s string
+			s, err = formatStructuredConfigValue(element)
+			if err != nil {
+				return
+			}
+			values = append(values, s)
+		}
+		result = strings.Join(values, ", ")
+	default:
+		err = fmt.Errorf("unsupported value: %v", value)
+	}
+	return
+}
+
+func connectSdrconnect(wsAddress string) (err error) {
+	wsIp := strings.Split(wsAddress, ":")[0]
+	origin := fmt.Sprintf("http://%s/", wsIp)
+	url := fmt.Sprintf("ws://%s/", wsAddress)
+	ws, err = websocket.Dial(url, "", origin)
+	return
+}
+
+// reconnectSdrconnect reconnects to SDRconnect after the websocket was
+// closed, retrying until it succeeds or the user terminates; with
+// 'reconnect resync = full' the cached settings are read again from
+// SDRconnect (so the scan settings are re-applied where they differ),
+// while with 'trust' the device state is assumed unchanged
+func reconnectSdrconnect(wsAddress string) (err error) {
+	priorityLog.Println("SDRconnect connection lost - reconnecting...")
+	ws.Close()
+	for {
+		if userCommandTerminate {
+			userCommandTerminate = false
+			return ErrUserCommandTerminate
+		}
+		err = connectSdrconnect(wsAddress)
+		if err == nil {
+			break
+		}
+		if debug {
+			priorityLog.Println("reconnect error:", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+	if reconnectResync == "full" {
+		sdrconnectSettings, err = getSdrconnectSettings()
+		if err != nil {
+			return
+		}
+	}
+	log.Printf("reconnected to SDRconnect (resync: %s)", reconnectResync)
+	return
+}
+
+// self test
+// each step is timed and reported as PASS or FAIL; the settings changed
+// by the test are restored
+func runSelfTest(wsAddress string) (passed bool) {
+	passed = true
+	step := func(name string, f func() error) bool {
+		start := time.Now()
+		err := f()
+		if err != nil {
+			priorityLog.Printf("selftest FAIL %s (%v): %v", name, time.Since(start).Round(time.Millisecond), err)
+			passed = false
+			return false
+		}
+		log.Printf("selftest PASS %s (%v)", name, time.Since(start).Round(time.Millisecond))
+		return true
+	}
+
+	if !step("connect", func() error { return connectSdrconnect(wsAddress) }) {
+		return
+	}
+	defer ws.Close()
+
+	if !step("read settings", func() (err error) {
+		sdrconnectSettings, err = getSdrconnectSettings()
+		return
+	}) {
+		return
+	}
+
+	// get/set/get round-trip on a harmless property
+	original := sdrconnectSettings.AudioMute
+	step("get/set/get audio_mute", func() (err error) {
+		value := strconv.FormatBool(!original)
+		_, _, err = setSdrconnectProperty("audio_mute", value)
+		if err != nil {
+			return
+		}
+		var actualValue string
+		actualValue, err = getSdrconnectProperty("audio_mute")
+		if err != nil {
+			return
+		}
+		if !samePropertyValue(actualValue, value) {
+			err = fmt.Errorf("requested: %s - actual: %s", value, actualValue)
+		}
+		return
+	})
+	step("restore audio_mute", func() (err error) {
+		_, _, err = setSdrconnectProperty("audio_mute", strconv.FormatBool(original))
+		return
+	})
+
+	// center frequency change with the CV sequence matching
+	originalCenterFrequency := sdrconnectSettings.DeviceCenterFrequency
+	originalVFOFrequency := sdrconnectSettings.DeviceVFOFrequency
+	step("set center frequency", func() error {
+		return setCenterFrequency(originalCenterFrequency + 10000)
+	})
+	step("restore center frequency", func() (err error) {
+		err = setCenterFrequency(originalCenterFrequency)
+		if err != nil {
+			return
+		}
+		_, _, err = setSdrconnectProperty("device_vfo_frequency", strconv.FormatUint(originalVFOFrequency, 10))
+		return
+	})
+
+	if passed {
+		log.Println("selftest passed")
+	} else {
+		priorityLog.Println("selftest failed")
+	}
+	return
+}
+
+// multiple configuration files are merged in order: the default settings
+// in later files override the earlier ones, and the scan sections are
+// appended
+func readConfigFile(configFiles []string) (scans []Scan, err error) {
+	// JSON and YAML configuration files are converted to INI
+	var sources []any
+	for _, configFile := range configFiles {
+		switch strings.ToLower(filepath.Ext(configFile)) {
+		case ".json", ".yaml", ".yml":
+			var source []byte
+			source, err = convertStructuredConfigFile(configFile)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, source)
+		default:
+			sources = append(sources, configFile)
+		}
+	}
+	config, err := ini.LoadSources(
+		ini.LoadOptions{
+			AllowNonUniqueSections: true,
+		},
+		sources[0],
+		sources[1:]...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	config.BlockMode = false
+	defaultSections, err := config.SectionsByName(ini.DefaultSection)
+	if err != nil {
+		return nil, err
+	}
+	// the default section is only used while the configuration file
+	// is read, but it is restored too if the file is not valid
+	previousDefaultSection := defaultSection
+	defer func() {
+		if err != nil {
+			defaultSection = previousDefaultSection
+		}
+	}()
+	defaultSection = defaultSections[0]
+	for _, section := range defaultSections[1:] {
+		for _, key := range section.Keys() {
+			defaultSection.Key(key.Name()).SetValue(key.Value())
+		}
+	}
+
+	// global settings
+	globalSettings := GlobalSettings{
+		topStations:      defaultSection.Key("top stations").MustInt(topStations),
+		scorePowerWeight: defaultSection.Key("score power weight").MustFloat64(scorePowerWeight),
+		scoreSNRWeight:   defaultSection.Key("score snr weight").MustFloat64(scoreSNRWeight),
+		scoreRDSWeight:   defaultSection.Key("score rds weight").MustFloat64(scoreRDSWeight),
+		verifySets:       defaultSection.Key("verify sets").MustBool(verifySets),
+		labelTolerance:   defaultSection.Key("label tolerance").MustUint64(labelTolerance),
+		waits:            make(map[*time.Duration]time.Duration),
+		// the key bindings start from the defaults every time, so a
+		// remapping removed from the file is undone
+		keyActions: maps.Clone(defaultKeyActions),
+	}
+	// wait times for each operation
+	for _, wait := range []struct {
+		name string
+		wait *time.Duration
+	}{
+		{"wait get property", &waitGetProperty},
+		{"wait set property", &waitSetProperty},
+		{"wait select device", &waitSelectDevice},
+		{"wait apply profile", &waitApplyProfile},
+		{"wait set center frequency", &waitSetCenterFrequency},
+	} {
+		if defaultSection.HasKey(wait.name) {
+			value := time.Duration(defaultSection.Key(wait.name).MustUint(0)) * time.Millisecond
+			if value == 0 {
+				err = fmt.Errorf("invalid %s: %s", wait.name, defaultSection.Key(wait.name).String())
+				return nil, err
+			}
+			globalSettings.waits[wait.wait] = value
+		}
+	}
+	globalSettings.reconnectResync = defaultSection.Key("reconnect resync").String()
+	switch globalSettings.reconnectResync {
+	case "", "full", "trust":
+	default:
+		err = fmt.Errorf("invalid reconnect resync: %s", globalSettings.reconnectResync)
+		return nil, err
+	}
+	for _, action := range []string{"terminate", "pause", "next", "lockout", "forward", "back", "jump"} {
+		key := defaultSection.Key("key " + action).String()
+		if key == "" {
+			continue
+		}
+		if key == "space" {
+			key = " "
+		}
+		if utf8.RuneCountInString(key) != 1 {
+			err = fmt.Errorf("invalid key %s: %s", action, key)
 			return nil, err
 		}
-		listenTime := defaultListenTime
-		if ok {
-			listenTime = time.Duration(listenTimeMs) * time.Millisecond
+		// the new key replaces the default ones for this action
+		for k, a := range globalSettings.keyActions {
+			if a == action {
+				delete(globalSettings.keyActions, k)
+			}
 		}
-		listenTimeRDSMs, ok, err := getUint32ConfigSetting("listen time rds", section)
+		r, _ := utf8.DecodeRuneInString(key)
+		globalSettings.keyActions[r] = action
+	}
+	globalSettings.cycleDelay = time.Duration(defaultSection.Key("cycle delay").MustUint(0)) * time.Millisecond
+	globalSettings.onStartScript = defaultSection.Key("on start").String()
+	globalSettings.onStopScript = defaultSection.Key("on stop").String()
+
+	scanSections, err := config.SectionsByName("scan")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, section := range scanSections {
+
+		hasRange := section.HasKey("range")
+		hasList := section.HasKey("list")
+		hasAround := section.HasKey("around")
+		hasListFile := section.HasKey("list file")
+		hasListCommand := section.HasKey("list command")
+		if countTrue(hasRange, hasList, hasAround, hasListFile, hasListCommand) != 1 {
+			err := fmt.Errorf("scan section should have one (and only one) of 'range', 'list', 'around', 'list file', or 'list command' settings")
+			return nil, err
+		}
+
+		var freqStart uint64
+		var freqStop uint64
+		var freqStep int64
+		var freqList []uint64
+		var listenTimes map[uint64]time.Duration
+		var listLabels map[uint64]string
+		if hasRange {
+			freqRangeValues := section.Key("range").Float64s(",")
+			if len(freqRangeValues) != 3 {
+				err := fmt.Errorf("range setting must have exactly three values")
+				return nil, err
+			}
+			if freqRangeValues[2] == 0 {
+				err := fmt.Errorf("range setting step value must not be 0")
+				return nil, err
+			}
+			if freqRangeValues[2] > 0 && !(freqRangeValues[1] > freqRangeValues[0]) {
+				err := fmt.Errorf("range setting end value must be greater than start value")
+				return nil, err
+			}
+			if freqRangeValues[2] < 0 && !(freqRangeValues[1] < freqRangeValues[0]) {
+				err := fmt.Errorf("range setting end value must be less than start value (negative step)")
+				return nil, err
+			}
+			freqStart = uint64(freqRangeValues[0])
+			freqStop = uint64(freqRangeValues[1])
+			freqStep = int64(freqRangeValues[2])
+		} else if hasList {
+			freqListValues := section.Key("list").Float64s(",")
+			if len(freqListValues) == 0 {
+				err := fmt.Errorf("invalid frequency scan list")
+				return nil, err
+			}
+			freqList = make([]uint64, 0, len(freqListValues))
+			for _, f := range freqListValues {
+				freqList = append(freqList, uint64(f))
+			}
+		} else if hasAround {
+			// center, span, step - expanded into the equivalent range
+			freqAroundValues := section.Key("around").Float64s(",")
+			if len(freqAroundValues) != 3 {
+				err := fmt.Errorf("around setting must have exactly three values")
+				return nil, err
+			}
+			center := freqAroundValues[0]
+			span := freqAroundValues[1]
+			step := freqAroundValues[2]
+			if span <= 0 || step <= 0 {
+				err := fmt.Errorf("around setting span and step values must be greater than 0")
+				return nil, err
+			}
+			if step > span {
+				err := fmt.Errorf("around setting step value must not be greater than span value")
+				return nil, err
+			}
+			if span >= center {
+				err := fmt.Errorf("around setting span value must be less than center value")
+				return nil, err
+			}
+			freqStart = uint64(center - span)
+			freqStop = uint64(center + span)
+			freqStep = int64(step)
+		} else if hasListFile {
+			freqList, listenTimes, err = readListFile(section.Key("list file").String())
+			if err != nil {
+				return nil, err
+			}
+			if len(freqList) == 0 {
+				err := fmt.Errorf("invalid frequency scan list file")
+				return nil, err
+			}
+		} else if hasListCommand {
+			freqList, listLabels, err = runListCommand(section.Key("list command").String())
+			if err != nil {
+				return nil, err
+			}
+			if len(freqList) == 0 {
+				err := fmt.Errorf("list command returned no frequencies")
+				return nil, err
+			}
+		}
+		listCommandRefresh := section.Key("list command refresh").MustBool(false)
+
+		snapFloat, ok, err := getFloat64ConfigSetting("snap", section)
+		if err != nil {
+			return nil, err
+		}
+		snap := uint64(snapFloat)
+		if snap != 0 {
+			// warn about frequencies that are not on the channel grid
+			if freqStep != 0 {
+				if freqStart%snap != 0 || uint64(max(freqStep, -freqStep))%snap != 0 {
+					log.Printf("range %d-%d step %d is not on the %d Hz channel grid - frequencies will be snapped", freqStart, freqStop, freqStep, snap)
+				}
+			} else {
+				for _, f := range freqList {
+					if snapFrequency(f, snap) != f {
+						log.Printf("frequency %d will be snapped to %d", f, snapFrequency(f, snap))
+					}
+				}
+			}
+		}
+
+		name := section.Key("name").MustString(fmt.Sprintf("scan%d", len(scans)+1))
+
+		dedupFrequencies, ok, err := getBoolConfigSetting("dedup frequencies", section)
+		if err != nil {
+			return nil, err
+		}
+
+		order, ok, err := getStringConfigSetting("order", section)
+		if err != nil {
+			return nil, err
+		}
+		order = strings.ToLower(order)
+		switch order {
+		case "", "file", "asc", "desc":
+		default:
+			err = fmt.Errorf("invalid order: %s", order)
+			return nil, err
+		}
+
+		deviceName, ok, err := getStringConfigSetting("device name", section)
+		if err != nil {
+			return nil, err
+		}
+		deviceSerial, ok, err := getStringConfigSetting("device serial", section)
+		if err != nil {
+			return nil, err
+		}
+		deviceSelectRetries, ok, err := getUint32ConfigSetting("device select retries", section)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			deviceSelectRetries = 3
+		}
+		if deviceName != "" && deviceSerial != "" {
+			err = fmt.Errorf("select only one of 'device name' or 'device serial'")
+			return nil, err
+		}
+		profile, ok, err := getStringConfigSetting("profile", section)
+		if err != nil {
+			return nil, err
+		}
+
+		detectPowerThreshold, ok, err := getFloat64ConfigSetting("detect power threshold", section)
+		if err != nil {
+			return nil, err
+		}
+		detectSNRThreshold, ok, err := getFloat64ConfigSetting("detect snr threshold", section)
+		if err != nil {
+			return nil, err
+		}
+		detectPowerMode, ok, err := getStringConfigSetting("detect power mode", section)
+		if err != nil {
+			return nil, err
+		}
+		switch detectPowerMode {
+		case "", "peak", "average":
+		default:
+			err = fmt.Errorf("invalid detect power mode: %s", detectPowerMode)
+			return nil, err
+		}
+		detectSmoothingAlpha, ok, err := getFloat64ConfigSetting("detect smoothing alpha", section)
+		if err != nil {
+			return nil, err
+		}
+		if detectSmoothingAlpha < 0 || detectSmoothingAlpha > 1 {
+			err = fmt.Errorf("detect smoothing alpha should be between 0 and 1")
+			return nil, err
+		}
+		detectSingleSample, ok, err := getBoolConfigSetting("detect single sample", section)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			detectSingleSample = true
+		}
+		detectPowerFloor, ok, err := getFloat64ConfigSetting("detect power floor", section)
+		if err != nil {
+			return nil, err
+		}
+		detectPowerFloorSet := ok
+		detectStereoPilot, ok, err := getBoolConfigSetting("detect stereo pilot", section)
+		if err != nil {
+			return nil, err
+		}
+		detectMinRDSRate, ok, err := getFloat64ConfigSetting("detect min rds rate", section)
+		if err != nil {
+			return nil, err
+		}
+		detectRequireRDS, ok, err := getBoolConfigSetting("detect require rds", section)
+		if err != nil {
+			return nil, err
+		}
+		detectRequireRDSTime, ok, err := getUint32ConfigSetting("detect require rds time", section)
+		if err != nil {
+			return nil, err
+		}
+		detectPowerThresholds := make(map[DemodulatorMode]float64)
+		detectSNRThresholds := make(map[DemodulatorMode]float64)
+		for dm := DemodulatorAM; dm <= DemodulatorWFM; dm++ {
+			mode := strings.ToLower(dm.String())
+			threshold, ok, err := getFloat64ConfigSetting("detect power threshold "+mode, section)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				detectPowerThresholds[dm] = threshold
+			}
+			threshold, ok, err = getFloat64ConfigSetting("detect snr threshold "+mode, section)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				detectSNRThresholds[dm] = threshold
+			}
+		}
+		stopOnFirst, ok, err := getStringConfigSetting("stop on first", section)
+		if err != nil {
+			return nil, err
+		}
+		switch stopOnFirst {
+		case "", "hold", "next":
+		default:
+			err = fmt.Errorf("invalid stop on first: %s", stopOnFirst)
+			return nil, err
+		}
+		resumeAfterHold, ok, err := getStringConfigSetting("resume after hold", section)
+		if err != nil {
+			return nil, err
+		}
+		switch resumeAfterHold {
+		case "", "next", "restart", "same":
+		default:
+			err = fmt.Errorf("invalid resume after hold: %s", resumeAfterHold)
+			return nil, err
+		}
+		detectMode, ok, err := getStringConfigSetting("detect mode", section)
+		if err != nil {
+			return nil, err
+		}
+		switch detectMode {
+		case "", "threshold", "squelch":
+		default:
+			err = fmt.Errorf("invalid detect mode: %s", detectMode)
+			return nil, err
+		}
+		detectFallback, ok, err := getStringConfigSetting("detect fallback", section)
+		if err != nil {
+			return nil, err
+		}
+		switch detectFallback {
+		case "", "none", "rds", "always":
+		default:
+			err = fmt.Errorf("invalid detect fallback: %s", detectFallback)
+			return nil, err
+		}
+		confirmOnListen, ok, err := getBoolConfigSetting("confirm on listen", section)
+		if err != nil {
+			return nil, err
+		}
+		detectTimeMs, ok, err := getUint32ConfigSetting("detect time", section)
+		if err != nil {
+			return nil, err
+		}
+		detectTime := defaultDetectTime
+		if ok {
+			detectTime = time.Duration(detectTimeMs) * time.Millisecond
+			if detectTime < waitSignalPowerAndSNR {
+				err = fmt.Errorf("detect time should be at least %v", waitSignalPowerAndSNR)
+				return nil, err
+			}
+		}
+		calibrateFrequencyFloat, ok, err := getFloat64ConfigSetting("calibrate frequency", section)
+		if err != nil {
+			return nil, err
+		}
+		calibrateMargin, ok, err := getFloat64ConfigSetting("calibrate margin", section)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			calibrateMargin = 10
+		}
+		calibrateTimeMs, ok, err := getUint32ConfigSetting("calibrate time", section)
+		if err != nil {
+			return nil, err
+		}
+		calibrateTime := 5 * detectTime
+		if ok {
+			calibrateTime = time.Duration(calibrateTimeMs) * time.Millisecond
+		}
+		listenTimeString, ok, err := getStringConfigSetting("listen time", section)
+		if err != nil {
+			return nil, err
+		}
+		listenTime := defaultListenTime
+		if ok {
+			// either ms or a multiple of the detect time (e.g. 10x)
+			if multiple, found := strings.CutSuffix(listenTimeString, "x"); found {
+				var listenTimeMultiple float64
+				listenTimeMultiple, err = strconv.ParseFloat(multiple, 64)
+				if err != nil || listenTimeMultiple <= 0 {
+					err = fmt.Errorf("invalid listen time: %s", listenTimeString)
+					return nil, err
+				}
+				listenTime = time.Duration(listenTimeMultiple * float64(detectTime))
+			} else {
+				var listenTimeMs uint64
+				listenTimeMs, err = strconv.ParseUint(listenTimeString, 10, 32)
+				if err != nil {
+					return nil, err
+				}
+				listenTime = time.Duration(listenTimeMs) * time.Millisecond
+			}
+		}
+		listenTimeRDSMs, ok, err := getUint32ConfigSetting("listen time rds", section)
+		if err != nil {
+			return nil, err
+		}
+		var listenExtraTimeRDS time.Duration
+		if ok {
+			listenTimeRDS := time.Duration(listenTimeRDSMs) * time.Millisecond
+			if listenTimeRDS < listenTime {
+				err = fmt.Errorf("listen time rds should be greater than or equal to listen time")
+				return nil, err
+			}
+			listenExtraTimeRDS = listenTimeRDS - listenTime
+		}
+		maxListenTimeMs, ok, err := getUint32ConfigSetting("max listen time", section)
+		if err != nil {
+			return nil, err
+		}
+		maxListenTime := time.Duration(maxListenTimeMs) * time.Millisecond
+		listenTimeMinMs, ok, err := getUint32ConfigSetting("listen time min", section)
+		if err != nil {
+			return nil, err
+		}
+		listenTimeMin := time.Duration(listenTimeMinMs) * time.Millisecond
+		listenTimeMaxMs, ok, err := getUint32ConfigSetting("listen time max", section)
+		if err != nil {
+			return nil, err
+		}
+		listenTimeMax := time.Duration(listenTimeMaxMs) * time.Millisecond
+		if (listenTimeMin > 0) != (listenTimeMax > 0) || listenTimeMin > listenTimeMax {
+			err = fmt.Errorf("listen time min and listen time max should be set together, with min <= max")
+			return nil, err
+		}
+		postListenCooldownMs, ok, err := getUint32ConfigSetting("post listen cooldown", section)
+		if err != nil {
+			return nil, err
+		}
+		postListenCooldown := time.Duration(postListenCooldownMs) * time.Millisecond
+		stepDelayMs, ok, err := getUint32ConfigSetting("step delay", section)
+		if err != nil {
+			return nil, err
+		}
+		onInitError, ok, err := getStringConfigSetting("on init error", section)
+		if err != nil {
+			return nil, err
+		}
+		switch onInitError {
+		case "", "abort", "skip":
+		default:
+			err = fmt.Errorf("invalid on init error: %s", onInitError)
+			return nil, err
+		}
+		demodulatorMismatch, ok, err := getStringConfigSetting("demodulator mismatch", section)
+		if err != nil {
+			return nil, err
+		}
+		switch demodulatorMismatch {
+		case "", "warn", "error":
+		default:
+			err = fmt.Errorf("invalid demodulator mismatch: %s", demodulatorMismatch)
+			return nil, err
+		}
+		detectAbsence, ok, err := getBoolConfigSetting("detect absence", section)
+		if err != nil {
+			return nil, err
+		}
+		detectionDeltas, ok, err := getBoolConfigSetting("detection deltas", section)
+		if err != nil {
+			return nil, err
+		}
+		setPropertyString, ok, err := getStringConfigSetting("set property", section)
+		if err != nil {
+			return nil, err
+		}
+		var setProperties []PropertyValue
+		if setPropertyString != "" {
+			for _, pair := range strings.Split(setPropertyString, ",") {
+				property, value, found := strings.Cut(strings.TrimSpace(pair), ":")
+				property = strings.TrimSpace(property)
+				if !found || property == "" {
+					err = fmt.Errorf("invalid set property: %s", pair)
+					return nil, err
+				}
+				setProperties = append(setProperties, PropertyValue{property, strings.TrimSpace(value)})
+			}
+		}
+		listenSquelch, ok, err := getStringConfigSetting("listen squelch", section)
+		if err != nil {
+			return nil, err
+		}
+		switch listenSquelch {
+		case "", "keep", "open":
+		default:
+			err = fmt.Errorf("invalid listen squelch: %s", listenSquelch)
+			return nil, err
+		}
+		rdsDominantPI, ok, err := getBoolConfigSetting("rds dominant pi", section)
+		if err != nil {
+			return nil, err
+		}
+		manualStep, ok, err := getBoolConfigSetting("manual step", section)
+		if err != nil {
+			return nil, err
+		}
+		mode, ok, err := getStringConfigSetting("mode", section)
+		if err != nil {
+			return nil, err
+		}
+		switch mode {
+		case "", "analog", "digital":
+		default:
+			err = fmt.Errorf("invalid mode: %s", mode)
+			return nil, err
+		}
+		digitalPropertiesString, ok, err := getStringConfigSetting("digital properties", section)
+		if err != nil {
+			return nil, err
+		}
+		var digitalProperties []string
+		if ok {
+			for _, property := range strings.Split(digitalPropertiesString, ",") {
+				digitalProperties = append(digitalProperties, strings.TrimSpace(property))
+			}
+		}
+		if mode == "digital" && len(digitalProperties) == 0 {
+			err = fmt.Errorf("mode digital requires the digital properties setting")
+			return nil, err
+		}
+		displayUnit, ok, err := getStringConfigSetting("display unit", section)
+		if err != nil {
+			return nil, err
+		}
+		displayUnit = strings.ToLower(displayUnit)
+		switch displayUnit {
+		case "", "hz", "khz", "mhz":
+		default:
+			err = fmt.Errorf("invalid display unit: %s", displayUnit)
+			return nil, err
+		}
+		displayPrecisionUint, ok, err := getUint32ConfigSetting("display precision", section)
+		if err != nil {
+			return nil, err
+		}
+		// -1 is the minimum number of digits needed
+		displayPrecision := -1
+		if ok {
+			displayPrecision = int(displayPrecisionUint)
+		}
+		rejectSpurs, ok, err := getBoolConfigSetting("reject spurs", section)
+		if err != nil {
+			return nil, err
+		}
+		fineSearch, ok, err := getUint32ConfigSetting("fine search", section)
+		if err != nil {
+			return nil, err
+		}
+		fineSearchSteps, ok, err := getUint32ConfigSetting("fine search steps", section)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			fineSearchSteps = 2
+		}
+		if fineSearch > 0 && fineSearchSteps == 0 {
+			err = fmt.Errorf("fine search steps should be greater than 0")
+			return nil, err
+		}
+		cwKeyingDetection, ok, err := getBoolConfigSetting("cw keying detection", section)
+		if err != nil {
+			return nil, err
+		}
+		detectionAgingTimeMs, ok, err := getUint32ConfigSetting("detection aging time", section)
+		if err != nil {
+			return nil, err
+		}
+		detectionAgingTime := time.Duration(detectionAgingTimeMs) * time.Millisecond
+		detectionRateLimitMs, ok, err := getUint32ConfigSetting("detection rate limit", section)
+		if err != nil {
+			return nil, err
+		}
+		detectionRateLimit := time.Duration(detectionRateLimitMs) * time.Millisecond
+		statsWindow, ok, err := getUint32ConfigSetting("stats window", section)
+		if err != nil {
+			return nil, err
+		}
+		warmupTimeMs, ok, err := getUint32ConfigSetting("warmup time", section)
+		if err != nil {
+			return nil, err
+		}
+		warmupTime := time.Duration(warmupTimeMs) * time.Millisecond
+		skipRDSPIString, ok, err := getStringConfigSetting("skip pi", section)
+		if err != nil {
+			return nil, err
+		}
+		var skipRDSPI []uint16
+		if ok {
+			for _, rdsPIString := range strings.Split(skipRDSPIString, ",") {
+				rdsPI, err := strconv.ParseUint(strings.TrimSpace(rdsPIString), 16, 16)
+				if err != nil {
+					return nil, fmt.Errorf("invalid RDS PI code in skip pi setting: %w", err)
+				}
+				skipRDSPI = append(skipRDSPI, uint16(rdsPI))
+			}
+		}
+		loOffsetString, ok, err := getStringConfigSetting("lo offset", section)
+		if err != nil {
+			return nil, err
+		}
+		var loOffset int32
+		var loOffsetPercent float64
+		if ok {
+			if percent, isPercent := strings.CutSuffix(strings.TrimSpace(loOffsetString), "%"); isPercent {
+				// resolved to Hz in initScan once the IF bandwidth is known
+				loOffsetPercent, err = strconv.ParseFloat(strings.TrimSpace(percent), 64)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				var loOffsetFloat float64
+				loOffsetFloat, err = strconv.ParseFloat(loOffsetString, 64)
+				if err != nil {
+					return nil, err
+				}
+				loOffset = int32(loOffsetFloat)
+			}
+		}
+		ifBandwidths, ok, err := getFloat64sConfigSetting("if bandwidths", section)
+		if err != nil {
+			return nil, err
+		}
+		var ifBandwidthskHz []uint32
+		for idx, ifBandwidth := range ifBandwidths {
+			if ifBandwidth <= 0 || (idx > 0 && ifBandwidth <= ifBandwidths[idx-1]) {
+				err = fmt.Errorf("if bandwidths should be positive and sorted in ascending order")
+				return nil, err
+			}
+			ifBandwidthskHz = append(ifBandwidthskHz, uint32(ifBandwidth))
+		}
+		minSpanFrequencies, ok, err := getUint32ConfigSetting("min span frequencies", section)
+		if err != nil {
+			return nil, err
+		}
+		centerHold, ok, err := getBoolConfigSetting("center hold", section)
+		if err != nil {
+			return nil, err
+		}
+		mergeDetectionsWithin, ok, err := getUint64ConfigSetting("merge detections within", section)
+		if err != nil {
+			return nil, err
+		}
+		occupancyFile, ok, err := getStringConfigSetting("occupancy file", section)
+		if err != nil {
+			return nil, err
+		}
+		output, ok, err := getStringConfigSetting("output", section)
+		if err != nil {
+			return nil, err
+		}
+		outputOnly, ok, err := getBoolConfigSetting("output only", section)
+		if err != nil {
+			return nil, err
+		}
+
+		// SDRconnect properties
+		sampleRate, ok, err := getFloat64ConfigSetting("sample rate", section)
+		if err != nil {
+			return nil, err
+		}
+		sampleRateOptions, ok, err := getFloat64sConfigSetting("sample rate options", section)
+		if err != nil {
+			return nil, err
+		}
+		if sampleRate != 0 && len(sampleRateOptions) > 0 {
+			err = fmt.Errorf("select only one of 'sample rate' or 'sample rate options'")
+			return nil, err
+		}
+		demodulatorString, ok, err := getStringConfigSetting("demodulator", section)
+		if err != nil {
+			return nil, err
+		}
+		var demodulator DemodulatorMode
+		if ok {
+			demodulator, err = ParseDemodulatorMode(demodulatorString)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// 'lna state = auto' leaves the gain to the AGC
+		lnaStateString, ok, err := getStringConfigSetting("lna state", section)
+		if err != nil {
+			return nil, err
+		}
+		lnaStateAuto := lnaStateString == "auto"
+		var lnaState uint32
+		var lnaStateSet bool
+		if !lnaStateAuto {
+			lnaState, ok, err = getUint32ConfigSetting("lna state", section)
+			if err != nil {
+				return nil, err
+			}
+			lnaStateSet = ok
+		}
+		antenna, ok, err := getStringConfigSetting("antenna", section)
+		if err != nil {
+			return nil, err
+		}
+		biasTee, ok, err := getBoolConfigSetting("bias tee", section)
+		if err != nil {
+			return nil, err
+		}
+		biasTeeSet := ok
+		squelchThreshold, ok, err := getFloat64ConfigSetting("squelch", section)
+		if err != nil {
+			return nil, err
+		}
+		squelchEnable := ok
+		if detectMode == "squelch" && !squelchEnable {
+			err = fmt.Errorf("detect mode squelch requires a squelch threshold")
+			return nil, err
+		}
+		agcThreshold, ok, err := getFloat64ConfigSetting("agc", section)
+		if err != nil {
+			return nil, err
+		}
+		agcEnable := ok
+		muteDuringDetect, ok, err := getBoolConfigSetting("mute during detect", section)
+		if err != nil {
+			return nil, err
+		}
+		autoPauseOnDetect, ok, err := getBoolConfigSetting("auto pause on detect", section)
+		if err != nil {
+			return nil, err
+		}
+		forceSettings, ok, err := getBoolConfigSetting("force settings", section)
+		if err != nil {
+			return nil, err
+		}
+
+		scans = append(scans, Scan{
+			Name:                  name,
+			Start:                 freqStart,
+			Stop:                  freqStop,
+			Step:                  freqStep,
+			List:                  freqList,
+			ListCommand:           section.Key("list command").String(),
+			ListCommandRefresh:    listCommandRefresh,
+			ListLabels:            listLabels,
+			Order:                 order,
+			Snap:                  snap,
+			DedupFrequencies:      dedupFrequencies,
+			DeviceName:            deviceName,
+			DeviceSerial:          deviceSerial,
+			DeviceSelectRetries:   deviceSelectRetries,
+			Profile:               profile,
+			OnInitError:           onInitError,
+			DemodulatorMismatch:   demodulatorMismatch,
+			DetectPowerThreshold:  detectPowerThreshold,
+			DetectSNRThreshold:    detectSNRThreshold,
+			DetectPowerThresholds: detectPowerThresholds,
+			DetectSNRThresholds:   detectSNRThresholds,
+			DetectPowerMode:       detectPowerMode,
+			DetectSmoothingAlpha:  detectSmoothingAlpha,
+			DetectSingleSample:    detectSingleSample,
+			DetectPowerFloorSet:   detectPowerFloorSet,
+			DetectPowerFloor:      detectPowerFloor,
+			DetectStereoPilot:     detectStereoPilot,
+			DetectMinRDSRate:      detectMinRDSRate,
+			DetectRequireRDS:      detectRequireRDS,
+			DetectRequireRDSTime:  time.Duration(detectRequireRDSTime) * time.Millisecond,
+			CalibrateFrequency:    uint64(calibrateFrequencyFloat),
+			CalibrateMargin:       calibrateMargin,
+			CalibrateTime:         calibrateTime,
+			DetectTime:            detectTime,
+			ListenTime:            listenTime,
+			ListenTimes:           listenTimes,
+			ListenExtraTimeRDS:    listenExtraTimeRDS,
+			MaxListenTime:         maxListenTime,
+			ListenTimeMin:         listenTimeMin,
+			ListenTimeMax:         listenTimeMax,
+			DetectionAgingTime:    detectionAgingTime,
+			DetectionRateLimit:    detectionRateLimit,
+			StatsWindow:           int(statsWindow),
+			WarmupTime:            warmupTime,
+			SkipRDSPI:             skipRDSPI,
+			StopOnFirst:           stopOnFirst,
+			ResumeAfterHold:       resumeAfterHold,
+			DetectMode:            detectMode,
+			DetectFallback:        detectFallback,
+			ConfirmOnListen:       confirmOnListen,
+			PostListenCooldown:    postListenCooldown,
+			StepDelay:             time.Duration(stepDelayMs) * time.Millisecond,
+			FineSearch:            fineSearch,
+			RejectSpurs:           rejectSpurs,
+			ManualStep:            manualStep,
+			Mode:                  mode,
+			DigitalProperties:     digitalProperties,
+			DisplayUnit:           displayUnit,
+			DisplayPrecision:      displayPrecision,
+			RDSDominantPI:         rdsDominantPI,
+			DetectAbsence:         detectAbsence,
+			DetectionDeltas:       detectionDeltas,
+			FineSearchSteps:       fineSearchSteps,
+			CWKeyingDetection:     cwKeyingDetection,
+			LOOffset:              loOffset,
+			LOOffsetPercent:       loOffsetPercent,
+			MinSpanFrequencies:    minSpanFrequencies,
+			CenterHold:            centerHold,
+			IFBandwidthskHz:       ifBandwidthskHz,
+			OccupancyFile:         occupancyFile,
+			MergeDetectionsWithin: mergeDetectionsWithin,
+			Output:                output,
+			OutputOnly:            outputOnly,
+			SampleRate:            sampleRate,
+			SampleRateOptions:     sampleRateOptions,
+			Demodulator:           demodulator,
+			LNAStateSet:           lnaStateSet,
+			LNAState:              lnaState,
+			LNAStateAuto:          lnaStateAuto,
+			Antenna:               antenna,
+			BiasTeeSet:            biasTeeSet,
+			BiasTee:               biasTee,
+			SquelchEnable:         squelchEnable,
+			SquelchThreshold:      squelchThreshold,
+			AGCEnable:             agcEnable,
+			AGCThreshold:          agcThreshold,
+			MuteDuringDetect:      muteDuringDetect,
+			AutoPauseOnDetect:     autoPauseOnDetect,
+			ListenSquelch:         listenSquelch,
+			SetProperties:         setProperties,
+			ForceSettings:         forceSettings,
+		})
+	}
+	warnOverlappingScans(scans)
+	applyGlobalSettings(&globalSettings)
+	return
+}
+
+func applyGlobalSettings(globalSettings *GlobalSettings) {
+	topStations = globalSettings.topStations
+	scorePowerWeight = globalSettings.scorePowerWeight
+	scoreSNRWeight = globalSettings.scoreSNRWeight
+	scoreRDSWeight = globalSettings.scoreRDSWeight
+	verifySets = globalSettings.verifySets
+	labelTolerance = globalSettings.labelTolerance
+	for wait, value := range globalSettings.waits {
+		*wait = value
+	}
+	reconnectResync = globalSettings.reconnectResync
+	keyActions = globalSettings.keyActions
+	cycleDelay = globalSettings.cycleDelay
+	onStartScript = globalSettings.onStartScript
+	onStopScript = globalSettings.onStopScript
+}
+
+// warnOverlappingScans warns about the frequencies covered by more than
+// one scan, since each scan runs independently with its own settings
+func warnOverlappingScans(scans []Scan) {
+	// the scans covering each frequency, by index
+	coverage := make(map[uint64][]int)
+	for idx := range scans {
+		done := make(chan struct{})
+		for freqAndIdx := range getScanFrequenciesAndIndexes(&scans[idx], done) {
+			coverage[freqAndIdx.frequency] = append(coverage[freqAndIdx.frequency], idx)
+		}
+		close(done)
+	}
+	type overlap struct {
+		count int
+		from  uint64
+		to    uint64
+	}
+	overlaps := make(map[[2]int]*overlap)
+	for freq, scanIdxs := range coverage {
+		// a scan might cover the same frequency more than once
+		scanIdxs = slices.Compact(scanIdxs)
+		for i := 0; i < len(scanIdxs); i++ {
+			for j := i + 1; j < len(scanIdxs); j++ {
+				pair := [2]int{scanIdxs[i], scanIdxs[j]}
+				o, ok := overlaps[pair]
+				if !ok {
+					o = &overlap{from: freq, to: freq}
+					overlaps[pair] = o
+				}
+				o.count++
+				o.from = min(o.from, freq)
+				o.to = max(o.to, freq)
+			}
+		}
+	}
+	pairs := slices.SortedFunc(maps.Keys(overlaps), func(a, b [2]int) int {
+		return cmp.Or(cmp.Compare(a[0], b[0]), cmp.Compare(a[1], b[1]))
+	})
+	for _, pair := range pairs {
+		o := overlaps[pair]
+		priorityLog.Printf("warning: scans %s and %s both cover %d frequencies (between %d and %d)", scans[pair[0]].Name, scans[pair[1]].Name, o.count, o.from, o.to)
+	}
+}
+
+func readLabelFile(labelFile string) (err error) {
+	var file *os.File
+	file, err = os.Open(labelFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+
+	for {
+		var record []string
+		record, err = reader.Read()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		if len(record) != 2 {
+			err = fmt.Errorf("invalid label record: %v", record)
+			return
+		}
+		var key uint64
+		if len(record[0]) == 4 {
+			// PI code
+			key, err = strconv.ParseUint(record[0], 16, 16)
+		} else {
+			// frequency
+			key, err = strconv.ParseUint(record[0], 10, 64)
+		}
+		if err != nil {
+			return
+		}
+		label := strings.TrimSpace(record[1])
+		currentLabel, ok := labels[key]
+		if ok {
+			labels[key] = currentLabel + "|" + label
+		} else {
+			labels[key] = label
+		}
+	}
+	updateLabelFrequencies()
+	return
+}
+
+// sorted labeled frequencies for the nearest label search
+// (keys up to 0xFFFF are RDS PI codes)
+func updateLabelFrequencies() {
+	labelFrequencies = nil
+	for key := range labels {
+		if key > 0xFFFF {
+			labelFrequencies = append(labelFrequencies, key)
+		}
+	}
+	slices.Sort(labelFrequencies)
+}
+
+// the list file is a CSV file with the frequency and optionally the
+// listen time (in ms) for that frequency in each row
+func readListFile(listFile string) (freqList []uint64, listenTimes map[uint64]time.Duration, err error) {
+	var file *os.File
+	file, err = os.Open(listFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	listenTimes = make(map[uint64]time.Duration)
+	for {
+		var record []string
+		record, err = reader.Read()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		if len(record) < 1 || len(record) > 2 {
+			err = fmt.Errorf("invalid list file record: %v", record)
+			return
+		}
+		// optional header
+		if strings.TrimSpace(record[0]) == "frequency" {
+			continue
+		}
+		var freq float64
+		freq, err = strconv.ParseFloat(strings.TrimSpace(record[0]), 64)
+		if err != nil {
+			return
+		}
+		freqList = append(freqList, uint64(freq))
+		if len(record) == 2 && strings.TrimSpace(record[1]) != "" {
+			var listenMs uint64
+			listenMs, err = strconv.ParseUint(strings.TrimSpace(record[1]), 10, 32)
+			if err != nil {
+				return
+			}
+			listenTimes[uint64(freq)] = time.Duration(listenMs) * time.Millisecond
+		}
+	}
+	return
+}
+
+// the list command writes the frequencies to be scanned to its standard
+// output, one per line, optionally followed by a comma and a label
+func runListCommand(command string) (freqList []uint64, listLabels map[uint64]string, err error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+	if debug {
+		log.Printf("running list command: %s", command)
+	}
+	var output []byte
+	output, err = cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("list command '%s' failed: %w", command, err)
+		return
+	}
+
+	listLabels = make(map[uint64]string)
+	for line := range strings.Lines(string(output)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		freqString, label, _ := strings.Cut(line, ",")
+		var freq float64
+		freq, err = strconv.ParseFloat(strings.TrimSpace(freqString), 64)
+		if err != nil {
+			err = fmt.Errorf("invalid list command output line: %s", line)
+			return
+		}
+		freqList = append(freqList, uint64(freq))
+		label = strings.TrimSpace(label)
+		if label != "" && uint64(freq) > 0xFFFF {
+			listLabels[uint64(freq)] = label
+		}
+	}
+	return
+}
+
+// addListLabels adds the labels returned by the list command of the scan
+// to the labels (they replace the labels file ones for the same frequency)
+func addListLabels(scan *Scan) {
+	if len(scan.ListLabels) == 0 {
+		return
+	}
+	maps.Copy(labels, scan.ListLabels)
+	updateLabelFrequencies()
+}
+
+// dumpLabelMap prints the labels in sorted order; keys up to 0xFFFF are
+// RDS PI codes, the others are frequencies
+func dumpLabelMap() {
+	keys := slices.Sorted(maps.Keys(labels))
+	for _, key := range keys {
+		if key <= math.MaxUint16 {
+			fmt.Printf("PI %04X: %s\n", key, labels[key])
+		} else {
+			fmt.Printf("frequency %d: %s\n", key, labels[key])
+		}
+	}
+}
+
+func getSdrconnectSettings() (settings SDRconnectSettings, err error) {
+	err = getSdrconnectSetting("device_sample_rate", func(value string) (err error) {
+		settings.SampleRate, err = strconv.ParseFloat(value, 64)
+		return
+	})
+	if err != nil {
+		return
+	}
+	err = getSdrconnectSetting("filter_bandwidth", func(value string) (err error) {
+		var filterBandwidth uint64
+		filterBandwidth, err = strconv.ParseUint(value, 10, 32)
+		settings.FilterBandwidth = uint32(filterBandwidth)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	// SDRconnect properties
+	err = getSdrconnectSetting("demodulator", func(value string) (err error) {
+		settings.Demodulator, err = ParseDemodulatorMode(value)
+		return
+	})
+	if err != nil {
+		return
+	}
+	err = getSdrconnectSetting("lna_state", func(value string) (err error) {
+		var lnaState uint64
+		lnaState, err = strconv.ParseUint(value, 10, 32)
+		settings.LNAState = uint32(lnaState)
+		return
+	})
+	if err != nil {
+		return
+	}
+	err = getSdrconnectSetting("squelch_enable", func(value string) (err error) {
+		settings.SquelchEnable, err = strconv.ParseBool(value)
+		return
+	})
+	if err != nil {
+		return
+	}
+	err = getSdrconnectSetting("squelch_threshold", func(value string) (err error) {
+		settings.SquelchThreshold, err = strconv.ParseFloat(value, 64)
+		return
+	})
+	if err != nil {
+		return
+	}
+	err = getSdrconnectSetting("agc_enable", func(value string) (err error) {
+		settings.AGCEnable, err = strconv.ParseBool(value)
+		return
+	})
+	if err != nil {
+		return
+	}
+	err = getSdrconnectSetting("agc_threshold", func(value string) (err error) {
+		settings.AGCThreshold, err = strconv.ParseFloat(value, 64)
+		return
+	})
+	if err != nil {
+		return
+	}
+	err = getSdrconnectSetting("audio_mute", func(value string) (err error) {
+		settings.AudioMute, err = strconv.ParseBool(value)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	err = getSdrconnectSetting("device_center_frequency", func(value string) (err error) {
+		settings.DeviceCenterFrequency, err = strconv.ParseUint(value, 10, 64)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	err = getSdrconnectSetting("device_vfo_frequency", func(value string) (err error) {
+		settings.DeviceVFOFrequency, err = strconv.ParseUint(value, 10, 64)
+		return
+	})
+	return
+}
+
+// getSdrconnectSetting reads a property and parses its value; since
+// SDRconnect might return unexpected values while it is still initializing
+// (e.g. during a device transition), an unparseable value is retried once
+// after a short wait, and then left unset with a warning; a property
+// rejected by SDRconnect (e.g. missing in older versions) or not answered
+// in time is also left unset with a warning
+func getSdrconnectSetting(property string, parse func(value string) error) (err error) {
+	for attempt := 1; ; attempt++ {
+		var value string
+		value, err = getSdrconnectProperty(property)
+		if errors.Is(err, ErrPropertyRejected) || isTimeoutError(err) {
+			priorityLog.Printf("warning: cannot read %s: %v - leaving it unset", property, err)
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		parseErr := parse(value)
+		if parseErr == nil {
+			return
+		}
+		if attempt == 2 {
+			priorityLog.Printf("warning: unexpected value for %s: '%s' - leaving it unset", property, value)
+			return
+		}
+		time.Sleep(waitGetProperty)
+	}
+}
+
+// run a session script with the shell; the event ('start' or 'stop')
+// and some context are passed to the script as environment variables
+func runSessionScript(script string, event string) (err error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", script)
+	} else {
+		cmd = exec.Command("sh", "-c", script)
+	}
+	cmd.Env = append(os.Environ(), sessionScriptEnv...)
+	cmd.Env = append(cmd.Env, "SDRCONNECT_SCANNER_EVENT="+event)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if debug {
+		log.Printf("running '%s' script: %s", event, script)
+	}
+	err = cmd.Run()
+	return
+}
+
+// run the 'on stop' script (at most once, no matter how the program exits)
+func runOnStopScript() {
+	onStopOnce.Do(func() {
+		if onStopScript == "" {
+			return
+		}
+		err := runSessionScript(onStopScript, "stop")
+		if err != nil {
+			priorityLog.Println("error running 'on stop' script:", err)
+		}
+	})
+}
+
+// runGetSetProperty sets and/or gets a single SDRconnect property (-set
+// and -get command line options)
+func runGetSetProperty(wsAddress string, getProperty string, setProperty string) (err error) {
+	var property, value string
+	if setProperty != "" {
+		var found bool
+		property, value, found = strings.Cut(setProperty, "=")
+		if !found {
+			err = errors.New("invalid -set argument - expected property=value")
+			return
+		}
+	}
+	err = connectSdrconnect(wsAddress)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	if setProperty != "" {
+		var actualValue string
+		var changed bool
+		actualValue, changed, err = setSdrconnectProperty(property, value)
+		if err != nil {
+			return
+		}
+		if changed {
+			fmt.Printf("%s=%s\n", property, actualValue)
+		} else {
+			fmt.Printf("%s=%s (change not confirmed by SDRconnect)\n", property, actualValue)
+		}
+	}
+	if getProperty != "" {
+		value, err = getSdrconnectProperty(getProperty)
+		if err != nil {
+			return
+		}
+		fmt.Printf("%s=%s\n", getProperty, value)
+	}
+	return
+}
+
+// like log.Fatal, but run the 'on stop' script first, since log.Fatal
+// exits without running the deferred functions
+func fatal(v ...any) {
+	runOnStopScript()
+	priorityLog.Fatal(v...)
+}
+
+// getActionKey returns the key bound to a user command, as shown in the
+// messages that tell the user which key to press
+func getActionKey(action string) string {
+	var keys []rune
+	for key, keyAction := range keyActions {
+		if keyAction == action {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return "(no key)"
+	}
+	// with both cases bound to the command, the lower case key is shown
+	key := slices.Max(keys)
+	if key == ' ' {
+		return "space"
+	}
+	return "'" + string(key) + "'"
+}
+
+func getKeyPresses() {
+	// frequency entry for the jump command
+	var entering bool
+	var entry []rune
+	for {
+		char, key, err := keyboard.GetKey()
+		if err != nil {
+			fatal(err)
+		}
+		if key == keyboard.KeyCtrlC {
+			userCommandTerminate = true
+			break
+		}
+		if entering {
+			switch {
+			case key == keyboard.KeyEnter:
+				entering = false
+				fmt.Print("\r\n")
+				freq, err := parseJumpFrequency(string(entry))
+				if err != nil {
+					priorityLog.Println(err)
+				} else {
+					userCommandJump = freq
+				}
+			case key == keyboard.KeyEsc:
+				entering = false
+				fmt.Print("\r\n")
+			case key == keyboard.KeyBackspace || key == keyboard.KeyBackspace2:
+				if len(entry) > 0 {
+					entry = entry[:len(entry)-1]
+					fmt.Print("\b \b")
+				}
+			case strings.ContainsRune("0123456789.kKmM", char):
+				entry = append(entry, char)
+				fmt.Print(string(char))
+			}
+			continue
+		}
+		if key == keyboard.KeySpace {
+			char = ' '
+		}
+		switch keyActions[char] {
+		case "terminate":
+			userCommandTerminate = true
+			return
+		case "pause":
+			userCommandTogglePause = true
+		case "next":
+			userCommandNextScan = true
+		case "lockout":
+			userCommandLockout = true
+		case "forward":
+			userCommandStep = 1
+		case "back":
+			userCommandStep = -1
+		case "jump":
+			entering = true
+			entry = entry[:0]
+			fmt.Print("\r\nfrequency (Hz, or with a k or M suffix; Esc cancels): ")
+		}
+	}
+}
+
+// parseJumpFrequency parses the frequency typed by the user, in Hz or
+// with a 'k' (kHz) or 'M' (MHz) suffix
+func parseJumpFrequency(entry string) (freq uint64, err error) {
+	multiplier := 1.0
+	if value, found := strings.CutSuffix(strings.ToLower(entry), "k"); found {
+		entry = value
+		multiplier = 1e3
+	} else if value, found := strings.CutSuffix(strings.ToLower(entry), "m"); found {
+		entry = value
+		multiplier = 1e6
+	}
+	value, err := strconv.ParseFloat(entry, 64)
+	if err != nil || value <= 0 {
+		err = fmt.Errorf("invalid frequency: %s", entry)
+		return
+	}
+	freq = uint64(math.Round(value * multiplier))
+	return
+}
+
+func initScan(scan *Scan) (err error) {
+	scan.Timing = TimingProfile{}
+	defer func(start time.Time) { scan.Timing.init = time.Since(start) }(time.Now())
+	if scan.ListCommand != "" && scan.ListCommandRefresh {
+		var freqList []uint64
+		var listLabels map[uint64]string
+		freqList, listLabels, err = runListCommand(scan.ListCommand)
+		if err != nil {
+			return
+		}
+		if len(freqList) == 0 {
+			priorityLog.Printf("warning: list command returned no frequencies - keeping the previous list")
+		} else {
+			// the LO spans are computed again for the new list
+			if !slices.Equal(freqList, scan.List) {
+				scan.List = freqList
+				scan.LOSpans = nil
+			}
+			scan.ListLabels = listLabels
+			addListLabels(scan)
+		}
+	}
+	// the device needs some time to stabilize at startup and after
+	// a device or profile change
+	warmup := warmupUntil.IsZero()
+	if scan.DeviceName != "" {
+		if scan.DeviceName != sdrconnectSettings.DeviceName {
+			err = selectDevice(scan, "device_name", scan.DeviceName, selectSdrconnectDeviceByName)
+			if err != nil {
+				return
+			}
+			sdrconnectSettings.DeviceName = scan.DeviceName
+			warmup = true
+		}
+	} else if scan.DeviceSerial != "" {
+		if scan.DeviceSerial != sdrconnectSettings.DeviceSerial {
+			err = selectDevice(scan, "device_serial", scan.DeviceSerial, selectSdrconnectDeviceBySerial)
+			if err != nil {
+				return
+			}
+			sdrconnectSettings.DeviceSerial = scan.DeviceSerial
+			warmup = true
+		}
+	}
+	if scan.Profile != sdrconnectSettings.Profile {
+		err = applySdrconnectProfile(scan.Profile)
+		if err != nil {
+			return
+		}
+		sdrconnectSettings.Profile = scan.Profile
+		warmup = true
+	}
+	if warmup {
+		warmupUntil = time.Now().Add(scan.WarmupTime)
+	}
+
+	// set specific SDRconnect properties are requested
+	// (unless forced, only the ones that are different from the cached value)
+	var result string
+
+	if scan.SampleRate != 0 {
+		if scan.SampleRate != sdrconnectSettings.SampleRate || scan.ForceSettings {
+			sampleRate := strconv.FormatFloat(scan.SampleRate, 'f', -1, 64)
+			var actualSampleRate string
+			actualSampleRate, _, err = setSdrconnectProperty("device_sample_rate", sampleRate)
+			if err != nil {
+				return
+			}
+			sdrconnectSettings.SampleRate, err = strconv.ParseFloat(actualSampleRate, 64)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if len(scan.SampleRateOptions) > 0 {
+		// try the sample rates in order until one is accepted
+		var accepted bool
+		for _, sampleRate := range scan.SampleRateOptions {
+			if sampleRate == sdrconnectSettings.SampleRate && !scan.ForceSettings {
+				accepted = true
+				break
+			}
+			if scan.RejectedSampleRates[sampleRate] {
+				continue
+			}
+			_, _, err = setSdrconnectProperty("device_sample_rate", strconv.FormatFloat(sampleRate, 'f', -1, 64))
+			if err != nil {
+				return
+			}
+			// a set timeout is reported as success, so read it back
+			result, err = getSdrconnectProperty("device_sample_rate")
+			if err != nil {
+				return
+			}
+			sdrconnectSettings.SampleRate, err = strconv.ParseFloat(result, 64)
+			if err != nil {
+				return
+			}
+			if sdrconnectSettings.SampleRate == sampleRate {
+				accepted = true
+				break
+			}
+			log.Printf("sample rate %v not accepted - actual: %v", sampleRate, sdrconnectSettings.SampleRate)
+			if scan.RejectedSampleRates == nil {
+				scan.RejectedSampleRates = make(map[float64]bool)
+			}
+			scan.RejectedSampleRates[sampleRate] = true
+		}
+		if !accepted {
+			err = fmt.Errorf("%w: none of the sample rate options was accepted - actual: %v", ErrPropertyRejected, sdrconnectSettings.SampleRate)
+			return
+		}
+	}
+
+	// the antenna state is not read at startup, so it is always set
+	// the first time
+	if scan.Antenna != "" {
+		if scan.Antenna != sdrconnectSettings.Antenna || scan.ForceSettings {
+			var actualAntenna string
+			actualAntenna, _, err = setSdrconnectProperty("antenna_select", scan.Antenna)
+			if err != nil {
+				return
+			}
+			if debug {
+				log.Printf("antenna_select: requested %s - actual %s", scan.Antenna, actualAntenna)
+			}
+			sdrconnectSettings.Antenna = actualAntenna
+		}
+	}
+
+	// the remaining properties are independent, so they are set in a batch
+	var properties []PropertyValue
+	if scan.Demodulator != DemodulatorUnknown {
+		if scan.Demodulator != sdrconnectSettings.Demodulator || scan.ForceSettings {
+			properties = append(properties, PropertyValue{"demodulator", scan.Demodulator.String()})
+		}
+	}
+
+	if scan.LNAStateSet {
+		if scan.LNAState != sdrconnectSettings.LNAState || scan.ForceSettings {
+			lnaState := strconv.FormatUint(uint64(scan.LNAState), 10)
+			properties = append(properties, PropertyValue{"lna_state", lnaState})
+		}
+	}
+
+	// the bias tee state is not read at startup, so it is always set
+	// the first time
+	if scan.BiasTeeSet {
+		if !sdrconnectSettings.BiasTeeKnown || scan.BiasTee != sdrconnectSettings.BiasTee || scan.ForceSettings {
+			properties = append(properties, PropertyValue{"bias_tee_enable", strconv.FormatBool(scan.BiasTee)})
+		}
+	}
+
+	if scan.SquelchEnable {
+		if scan.SquelchEnable != sdrconnectSettings.SquelchEnable || scan.ForceSettings {
+			properties = append(properties, PropertyValue{"squelch_enable", "true"})
+		}
+		if scan.SquelchThreshold != sdrconnectSettings.SquelchThreshold || scan.ForceSettings {
+			squelchThreshold := strconv.FormatFloat(scan.SquelchThreshold, 'f', -1, 64)
+			properties = append(properties, PropertyValue{"squelch_threshold", squelchThreshold})
+		}
+	}
+
+	if scan.LNAStateAuto && !scan.AGCEnable {
+		if !sdrconnectSettings.AGCEnable || scan.ForceSettings {
+			properties = append(properties, PropertyValue{"agc_enable", "true"})
+		}
+	}
+
+	if scan.AGCEnable {
+		if scan.AGCEnable != sdrconnectSettings.AGCEnable || scan.ForceSettings {
+			properties = append(properties, PropertyValue{"agc_enable", "true"})
+		}
+		if scan.AGCThreshold != sdrconnectSettings.AGCThreshold || scan.ForceSettings {
+			agcThreshold := strconv.FormatFloat(scan.AGCThreshold, 'f', -1, 64)
+			properties = append(properties, PropertyValue{"agc_threshold", agcThreshold})
+		}
+	}
+
+	var actualValues map[string]string
+	actualValues, err = setSdrconnectProperties(properties)
+	if err != nil {
+		return
+	}
+	if debug {
+		for _, property := range properties {
+			log.Printf("%s: requested %s - actual %s", property.property, property.value, actualValues[property.property])
+		}
+	}
+	if demodulator, ok := actualValues["demodulator"]; ok {
+		sdrconnectSettings.Demodulator, err = ParseDemodulatorMode(demodulator)
+		if err != nil {
+			return
+		}
+		// SDRconnect might substitute a mode that is not supported
+		// for the band or the device
+		if sdrconnectSettings.Demodulator != scan.Demodulator {
+			if scan.DemodulatorMismatch == "error" {
+				err = fmt.Errorf("scan %s: requested demodulator %s - SDRconnect applied %s", scan.Name, scan.Demodulator, sdrconnectSettings.Demodulator)
+				return
+			}
+			priorityLog.Printf("warning: scan %s: requested demodulator %s - SDRconnect applied %s", scan.Name, scan.Demodulator, sdrconnectSettings.Demodulator)
+		}
+	}
+	if _, ok := actualValues["lna_state"]; ok {
+		sdrconnectSettings.LNAState = scan.LNAState
+		sdrconnectSettings.LNAStateAuto = false
+	}
+	if biasTee, ok := actualValues["bias_tee_enable"]; ok {
+		sdrconnectSettings.BiasTee, _ = strconv.ParseBool(biasTee)
+		sdrconnectSettings.BiasTeeKnown = true
+	}
+	if _, ok := actualValues["squelch_enable"]; ok {
+		sdrconnectSettings.SquelchEnable = scan.SquelchEnable
+	}
+	if _, ok := actualValues["squelch_threshold"]; ok {
+		sdrconnectSettings.SquelchThreshold = scan.SquelchThreshold
+	}
+	if _, ok := actualValues["agc_enable"]; ok {
+		sdrconnectSettings.AGCEnable = true
+	}
+	if scan.LNAStateAuto {
+		sdrconnectSettings.LNAStateAuto = sdrconnectSettings.AGCEnable
+	}
+	if _, ok := actualValues["agc_threshold"]; ok {
+		sdrconnectSettings.AGCThreshold = scan.AGCThreshold
+	}
+
+	// generic properties are applied verbatim
+	for _, property := range scan.SetProperties {
+		if currentValue, ok := sdrconnectSettings.Properties[property.property]; ok && currentValue == property.value && !scan.ForceSettings {
+			continue
+		}
+		var actualValue string
+		actualValue, _, err = setSdrconnectProperty(property.property, property.value)
+		if err != nil {
+			return
+		}
+		log.Printf("set property %s=%s - actual: %s", property.property, property.value, actualValue)
+		if sdrconnectSettings.Properties == nil {
+			sdrconnectSettings.Properties = make(map[string]string)
+		}
+		sdrconnectSettings.Properties[property.property] = actualValue
+	}
+
+	// make sure we know the current sample rate and filter bandwidth
+	if sdrconnectSettings.SampleRate == 0 {
+		result, err = getSdrconnectProperty("device_sample_rate")
+		if err != nil {
+			return
+		}
+		sdrconnectSettings.SampleRate, err = strconv.ParseFloat(result, 64)
+		if err != nil {
+			return
+		}
+	}
+
+	if sdrconnectSettings.FilterBandwidth == 0 {
+		result, err = getSdrconnectProperty("filter_bandwidth")
+		if err != nil {
+			return
+		}
+		var filterBandwidth uint64
+		filterBandwidth, err = strconv.ParseUint(result, 10, 32)
+		if err != nil {
+			return
+		}
+		sdrconnectSettings.FilterBandwidth = uint32(filterBandwidth)
+	}
+
+	if scan.LOSpans == nil {
+		err = computeLOSpans(scan)
+		if err != nil {
+			return
+		}
+	}
+
+	// calibrate once, after the gain settings have been applied
+	if scan.CalibrateFrequency != 0 && !scan.Calibrated {
+		if !useCachedThresholds(scan) {
+			err = calibrateThresholds(scan)
+			if err != nil {
+				return
+			}
+		}
+		scan.Calibrated = true
+	}
+
+	if scan.Output != "" && scan.OutputWriter == nil {
+		var file *os.File
+		file, err = os.OpenFile(scan.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return
+		}
+		var fileInfo os.FileInfo
+		fileInfo, err = file.Stat()
+		if err != nil {
+			file.Close()
+			return
+		}
+		scan.OutputWriter = csv.NewWriter(file)
+		// the header is written only once, when the file is created
+		if fileInfo.Size() == 0 {
+			scan.OutputWriter.Write([]string{"time", "scan", "event", "frequency", "details"})
+			scan.OutputWriter.Flush()
+		}
+	}
+
+	return
+}
+
+func runScan(scan *Scan) (err error) {
+	scanStart := time.Now()
+	scanning = true
+	defer func() { scanning = false }()
+	// the scan resumes where it was after a frequency jump
+	resumeFrequency := scan.ResumeFrequency
+	scan.ResumeFrequency = 0
+	if scan.ManualStep {
+		err = runManualStep(scan, resumeFrequency)
+		return
+	}
+	if scan.Mode == "digital" {
+		err = runDigitalScan(scan, resumeFrequency)
+		return
+	}
+	if scan.MuteDuringDetect {
+		defer setAudioMute(false)
+	}
+	var cooldown bool
+	for {
+		var restart bool
+		resumeFrequency, restart, err = runScanPass(scan, resumeFrequency, &cooldown)
+		if err != nil {
+			return
+		}
+		// a new pass starts when the LO spans are recomputed (from the
+		// frequency where the filter bandwidth change was detected) or
+		// when the user restarts the scan
+		if resumeFrequency == 0 && !restart {
+			break
+		}
+	}
+	if scan.OccupancyFile != "" {
+		if err := writeOccupancyFile(scan); err != nil {
+			priorityLog.Println("error writing occupancy file:", err)
+		}
+	}
+	if scan.MergeDetectionsWithin > 0 {
+		showMergedDetections(scan)
+	}
+	if scan.DetectionDeltas {
+		showDetectionDeltas(scan)
+	}
+	if scan.CenterHold {
+		log.Printf("scan %s: center hold saved %d retunes in the last pass", scan.Name, scan.RetunesSaved)
+	}
+	if timingProfile {
+		showTimingProfile(scan, time.Since(scanStart))
+	}
+	if db != nil {
+		if err := commitDatabase(); err != nil {
+			priorityLog.Println("error writing detections to database:", err)
+		}
+	}
+	return
+}
+
+// runScanPass runs a single pass over the frequencies of the scan,
+// starting from the resume frequency if it is set
+func runScanPass(scan *Scan, resumeFrequency uint64, cooldown *bool) (nextResumeFrequency uint64, restart bool, err error) {
+	done := make(chan struct{})
+	defer close(done)
+	var resumeLOFrequency uint64
+	var stepped bool
+	// the resume frequency might not be in the scan anymore (for
+	// instance after a list refresh or a reload)
+	if resumeFrequency != 0 && !isScanFrequency(scan, resumeFrequency) {
+		log.Printf("scan %s: resume frequency %d not in the scan anymore - starting from the first frequency", scan.Name, resumeFrequency)
+		resumeFrequency = 0
+	}
+	scan.RetunesSaved = 0
+	for freqAndLOFreq := range getScanFrequenciesAndLOFrequencies(scan, done) {
+		loFreq := freqAndLOFreq.loFrequency
+		// with center hold, the center frequency is not changed at the
+		// start of every LO span
+		if freqAndLOFreq.spanStart {
+			scan.RetunesSaved++
+		}
+		if loFreq != 0 {
+			scan.RetunesSaved--
+		}
+		if resumeFrequency != 0 {
+			if loFreq != 0 {
+				resumeLOFrequency = loFreq
+			}
+			if freqAndLOFreq.frequency != resumeFrequency {
+				continue
+			}
+			resumeFrequency = 0
+			loFreq = resumeLOFrequency
+		}
+		// the LO spans are stale if a profile or mode change
+		// altered the filter bandwidth
+		if sdrconnectSettings.FilterBandwidth != scan.LOSpansFilterBandwidth {
+			log.Printf("scan %s: filter bandwidth changed from %d to %d - recomputing the LO spans", scan.Name, scan.LOSpansFilterBandwidth, sdrconnectSettings.FilterBandwidth)
+			err = computeLOSpans(scan)
+			if err != nil {
+				return
+			}
+			nextResumeFrequency = freqAndLOFreq.frequency
+			return
+		}
+		if loFreq != 0 && loFreq != sdrconnectSettings.DeviceCenterFrequency {
+			retuneStart := time.Now()
+			err = setCenterFrequency(loFreq)
+			scan.Timing.retune += time.Since(retuneStart)
+			scan.Timing.retunes++
+			if err != nil {
+				return
+			}
+		}
+
+		// the LO is set anyway, since it is only set
+		// at the start of each LO span
+		if lockedOutFrequencies[freqAndLOFreq.frequency] {
+			continue
+		}
+		// don't overwhelm SDRconnect with frequency changes
+		// (the user commands are still handled while waiting)
+		if stepped && scan.StepDelay > 0 {
+			err = receiveMessages(&sdrconnectSettings, "step delay", nil, scan.StepDelay)
+			if err != nil {
+				return
+			}
+		}
+		stepped = true
+
+		clearReceiveStats()
+
+		if scan.MuteDuringDetect {
+			err = setAudioMute(true)
+			if err != nil {
+				return
+			}
+		}
+
+		freq := freqAndLOFreq.frequency
+		scan.CurrentFrequency = freq
+		detectStart := time.Now()
+		scan.Timing.frequencies++
+		if *cooldown && scan.PostListenCooldown > 0 {
+			// let AGC and squelch recover from the previous listen
+			// and discard the stats collected in the meantime
+			err = setVFOFrequencyAndGetSignalStats(freq, scan.PostListenCooldown)
+			if err != nil {
+				return
+			}
+			clearReceiveStats()
+			err = receiveMessages(&sdrconnectSettings, "detect", nil, scan.DetectTime)
+		} else {
+			err = setVFOFrequencyAndGetSignalStats(freq, scan.DetectTime)
+		}
+		if err != nil {
+			return
+		}
+		if scan.FineSearch > 0 {
+			// probe a few offsets around the frequency and keep
+			// the one with the strongest signal
+			bestFreq := freq
+			bestPower := getSignalMax(receiveStats.signalPower)
+			lastFreq := freq
+			steps := int64(scan.FineSearchSteps)
+			for k := -steps; k <= steps; k++ {
+				if k == 0 {
+					continue
+				}
+				offsetFreq := uint64(int64(freq) + k*int64(scan.FineSearch)/steps)
+				clearReceiveStats()
+				err = setVFOFrequencyAndGetSignalStats(offsetFreq, scan.DetectTime)
+				if err != nil {
+					return
+				}
+				lastFreq = offsetFreq
+				if power := getSignalMax(receiveStats.signalPower); power > bestPower {
+					bestFreq = offsetFreq
+					bestPower = power
+				}
+			}
+			if bestFreq != lastFreq {
+				clearReceiveStats()
+				err = setVFOFrequencyAndGetSignalStats(bestFreq, scan.DetectTime)
+				if err != nil {
+					return
+				}
+			}
+			if debug && bestFreq != freq {
+				log.Printf("fine search: strongest signal at %d (offset %+d)", bestFreq, int64(bestFreq)-int64(freq))
+			}
+		}
+		*cooldown = false
+		scan.Timing.detect += time.Since(detectStart)
+		if spectrogramDir != "" && len(receiveStats.signalPower) > 0 {
+			addSpectrogramSample(scan, freq, getSignalMax(receiveStats.signalPower))
+		}
+		signalDetected, trigger := detectSignal(scan)
+		if time.Now().Before(warmupUntil) {
+			if signalDetected && debug {
+				log.Printf("ignoring detection at %d during warmup", freq)
+			}
+			// the pass is counted anyway, as without a detection
+			if scan.OccupancyFile != "" {
+				updateOccupancy(scan, freq, false)
+			}
+			continue
+		}
+		if signalDetected && scan.RejectSpurs {
+			signalDetected, trigger, err = recheckWithShiftedLO(scan, freq)
+			if err != nil {
+				return
+			}
+			if !signalDetected && debug {
+				log.Printf("rejecting spur at %d", freq)
+			}
+		}
+		if signalDetected && scan.DetectRequireRDS {
+			rdsStart := time.Now()
+			signalDetected, err = waitForRDSPI(scan)
+			scan.Timing.detect += time.Since(rdsStart)
+			if err != nil {
+				return
+			}
+			if !signalDetected && debug {
+				log.Printf("unconfirmed detection at %d - no RDS PI received", freq)
+			}
+		}
+		if scan.OccupancyFile != "" && !signalDetected {
+			updateOccupancy(scan, freq, false)
+		}
+		if (scan.DetectAbsence || scan.DetectionDeltas) && !signalDetected {
+			updateActiveState(scan, freq, false)
+		}
+		if signalDetected {
+			receiveStats.detectTrigger = trigger
+			// a station skipped by its RDS PI is dropped before it
+			// is shown (its PI might also be decoded only later,
+			// while listening)
+			if rdsPI, ok := getSkippedRDSPI(scan); ok {
+				if debug {
+					log.Printf("skipping RDS/PI=%04X at %d", rdsPI, freq)
+				}
+				// the channel is occupied, even if the station
+				// is not shown
+				if scan.OccupancyFile != "" {
+					updateOccupancy(scan, freq, true)
+				}
+				continue
+			}
+			if scan.MuteDuringDetect {
+				err = setAudioMute(false)
+				if err != nil {
+					return
+				}
+			}
+			*cooldown = true
+			// repeated detections are only logged in debug mode
+			isNew := trackDetection(freq, scan.DetectionAgingTime)
+			if isNew && isDetectionRateLimited(freq, scan.DetectionRateLimit) {
+				isNew = false
+			}
+			// with confirm on listen, the detection is shown only
+			// once the signal is confirmed
+			if (isNew || debug) && !scan.ConfirmOnListen {
+				showStats(scan, "detect")
+			}
+			listenSignalPowerFrom := len(receiveStats.signalPower)
+			listenSignalSNRFrom := len(receiveStats.signalSNR)
+			// open the squelch while listening, so nothing is chopped
+			squelchOpened := scan.ListenSquelch == "open" && sdrconnectSettings.SquelchEnable
+			if squelchOpened {
+				err = setSquelchEnable(false)
+				if err != nil {
+					return
+				}
+			}
+			// the listen time and its extensions are capped
+			// by the max listen time
+			listenTime := freqAndLOFreq.listenTime
+			var capped bool
+			if scan.MaxListenTime > 0 && listenTime > scan.MaxListenTime {
+				listenTime = scan.MaxListenTime
+				capped = true
+			}
+			// like a traditional scanner's manual resume, the
+			// listen is paused until the user presses the pause key
+			if scan.AutoPauseOnDetect {
+				priorityLog.Printf("paused on detection at %d - press %s to resume scanning", freq, getActionKey("pause"))
+				userCommandTogglePause = true
+			}
+			listenStart := time.Now()
+			scan.Timing.listens++
+			err = receiveMessages(&sdrconnectSettings, "listen", nil, listenTime)
+			if err == nil && len(receiveStats.rdsPI) > 0 && scan.ListenExtraTimeRDS > 0 {
+				listenExtraTime := scan.ListenExtraTimeRDS
+				if scan.MaxListenTime > 0 && listenTime+listenExtraTime > scan.MaxListenTime {
+					listenExtraTime = scan.MaxListenTime - listenTime
+					capped = true
+				}
+				if listenExtraTime > 0 {
+					err = receiveMessages(&sdrconnectSettings, "listen", nil, listenExtraTime)
+				}
+			}
+			scan.Timing.listen += time.Since(listenStart)
+			if capped {
+				log.Printf("max listen time reached at %d - moving on", freq)
+			}
+			if squelchOpened {
+				if err := setSquelchEnable(true); err != nil {
+					priorityLog.Println("error restoring squelch:", err)
+				}
+			}
+			if err != nil {
+				return
+			}
+			if scan.RDSDominantPI {
+				filterRDSPSByDominantPI()
+			}
+			confirmed := !scan.ConfirmOnListen || confirmSignal(scan, listenSignalPowerFrom, listenSignalSNRFrom, time.Since(listenStart))
+			if scan.OccupancyFile != "" {
+				updateOccupancy(scan, freq, confirmed)
+			}
+			if scan.DetectAbsence || scan.DetectionDeltas {
+				updateActiveState(scan, freq, confirmed)
+			}
+			if !confirmed {
+				if debug {
+					log.Printf("false positive at %d - signal not confirmed while listening", freq)
+				}
+				continue
+			}
+			if rdsPI, ok := getSkippedRDSPI(scan); ok {
+				if debug {
+					log.Printf("skipping RDS/PI=%04X at %d", rdsPI, freq)
+				}
+				continue
+			}
+			if scan.ConfirmOnListen && (isNew || debug) {
+				showStats(scan, "detect")
+			}
+			if trackDetectionRDSPI(freq) {
+				isNew = true
+			}
+			recordDetection(scan, freq)
+			if db != nil {
+				if err := insertDetection(scan, freq); err != nil {
+					priorityLog.Println("error writing detection to database:", err)
+				}
+			}
+			if mqttClient != nil {
+				publishDetection(scan, freq)
+			}
+			if isNew || debug {
+				showStats(scan, "listen")
+			}
+			if scan.StopOnFirst == "hold" {
+				err = holdOnDetection(scan, freq)
+				if err != nil {
+					return
+				}
+				// the user ended the hold
+				if scan.ResumeAfterHold == "restart" {
+					restart = true
+					break
+				}
+			} else if scan.StopOnFirst == "next" {
+				break
+			}
+		}
+	}
+	return
+}
+
+// getSkippedRDSPI returns the first of the RDS PIs received that is in
+// the 'skip rds pi' list
+func getSkippedRDSPI(scan *Scan) (rdsPI uint16, ok bool) {
+	for _, rdsPI = range receiveStats.rdsPI {
+		if slices.Contains(scan.SkipRDSPI, rdsPI) {
+			return rdsPI, true
+		}
+	}
+	return 0, false
+}
+
+// holdOnDetection stays on this frequency until the user moves on;
+// with 'resume after hold' the user ends the hold with 'n' (otherwise
+// 'n' moves on to the next scan), and with 'resume after hold = same'
+// the frequency is checked again and held as long as the signal is there
+func holdOnDetection(scan *Scan, freq uint64) (err error) {
+	for {
+		if scan.ResumeAfterHold == "" {
+			log.Printf("holding on first detection - press %s for the next scan", getActionKey("next"))
+		} else {
+			log.Printf("holding on first detection - press %s to resume scanning", getActionKey("next"))
+		}
+		for err == nil {
+			err = receiveMessages(&sdrconnectSettings, "hold", nil, scan.ListenTime)
+		}
+		if scan.ResumeAfterHold == "" || !errors.Is(err, ErrUserCommandNextScan) {
+			return
+		}
+		err = nil
+		if scan.ResumeAfterHold != "same" {
+			return
+		}
+		clearReceiveStats()
+		err = setVFOFrequencyAndGetSignalStats(freq, scan.DetectTime)
+		if err != nil {
+			return
+		}
+		if signalDetected, _ := detectSignal(scan); !signalDetected {
+			return
+		}
+		showStats(scan, "listen")
+	}
+}
+
+// jumpToFrequency tunes to the frequency entered by the user and holds
+// there until the user presses 'n'; the scan then resumes from the
+// frequency it was on (the nominal scan frequency, not the VFO frequency,
+// which might be a fine search offset)
+func jumpToFrequency(scan *Scan) (err error) {
+	scanning = true
+	defer func() { scanning = false }()
+	if scan.ResumeFrequency == 0 {
+		scan.ResumeFrequency = scan.CurrentFrequency
+	}
+	for {
+		freq := userCommandJump
+		userCommandJump = 0
+		loFreq := uint64(int64(freq) + int64(scan.LOOffset))
+		if loFreq != sdrconnectSettings.DeviceCenterFrequency {
+			err = setCenterFrequency(loFreq)
+			if err != nil {
+				return
+			}
+		}
+		clearReceiveStats()
+		err = setVFOFrequencyAndGetSignalStats(freq, scan.DetectTime)
+		if err != nil {
+			return
+		}
+		showStats(scan, "jump")
+		log.Printf("holding at %d - press %s to resume scanning", freq, getActionKey("next"))
+		for err == nil {
+			err = receiveMessages(&sdrconnectSettings, "hold", nil, scan.ListenTime)
+		}
+		if errors.Is(err, ErrUserCommandNextScan) {
+			err = nil
+			return
+		}
+		if !errors.Is(err, ErrUserCommandJump) {
+			return
+		}
+		err = nil
+	}
+}
+
+// manual step mode
+// the scanner stays on each frequency showing the live stats until the
+// user steps forward or back
+func runManualStep(scan *Scan, resumeFrequency uint64) (err error) {
+	manualStep = true
+	userCommandStep = 0
+	defer func() { manualStep = false }()
+
+	// the LO frequency is only given at the start of each LO span,
+	// so it is filled in for all the frequencies to be able to go back
+	var frequencies []FrequencyAndLOFrequency
+	var loFreq uint64
+	done := make(chan struct{})
+	for freqAndLOFreq := range getScanFrequenciesAndLOFrequencies(scan, done) {
+		if freqAndLOFreq.loFrequency != 0 {
+			loFreq = freqAndLOFreq.loFrequency
+		}
+		freqAndLOFreq.loFrequency = loFreq
+		frequencies = append(frequencies, freqAndLOFreq)
+	}
+	close(done)
+
+	log.Printf("manual step - press %s for the next frequency, %s for the previous one", getActionKey("forward"), getActionKey("back"))
+	idx := 0
+	if resumeFrequency != 0 {
+		idx = max(slices.IndexFunc(frequencies, func(freqAndLOFreq FrequencyAndLOFrequency) bool {
+			return freqAndLOFreq.frequency == resumeFrequency
+		}), 0)
+	}
+	for idx < len(frequencies) {
+		freqAndLOFreq := frequencies[idx]
+		scan.CurrentFrequency = freqAndLOFreq.frequency
+		if freqAndLOFreq.loFrequency != sdrconnectSettings.DeviceCenterFrequency {
+			err = setCenterFrequency(freqAndLOFreq.loFrequency)
+			if err != nil {
+				return
+			}
+		}
+		clearReceiveStats()
+		err = setVFOFrequencyAndGetSignalStats(freqAndLOFreq.frequency, scan.DetectTime)
+		for err == nil {
+			showStats(scan, "")
+			clearReceiveStats()
+			err = receiveMessages(&sdrconnectSettings, "manual step", nil, scan.DetectTime)
+		}
+		if !errors.Is(err, ErrUserCommandStep) {
+			return
+		}
+		err = nil
+		idx = max(idx+userCommandStep, 0)
+		userCommandStep = 0
+	}
+	return
+}
+
+// showTimingProfile shows how the time of the scan was spent, so for
+// instance excessive retunes caused by a poor IF bandwidth choice stand out
+func showTimingProfile(scan *Scan, total time.Duration) {
+	timing := &scan.Timing
+	other := total - timing.retune - timing.detect - timing.listen
+	percent := func(d time.Duration) float64 {
+		if total == 0 {
+			return 0
+		}
+		return 100 * float64(d) / float64(total)
+	}
+	log.Printf("scan %s timing: init=%v total=%v retune=%v (%.1f%%, %d retunes) detect=%v (%.1f%%, %d frequencies) listen=%v (%.1f%%, %d listens) other=%v (%.1f%%)",
+		scan.Name, timing.init.Round(time.Millisecond), total.Round(time.Millisecond),
+		timing.retune.Round(time.Millisecond), percent(timing.retune), timing.retunes,
+		timing.detect.Round(time.Millisecond), percent(timing.detect), timing.frequencies,
+		timing.listen.Round(time.Millisecond), percent(timing.listen), timing.listens,
+		other.Round(time.Millisecond), percent(other))
+}
+
+// digital mode
+// for digital broadcasts (e.g. DAB) the center frequency is tuned to each
+// ensemble channel, and the digital metadata properties exposed by
+// SDRconnect are read instead of detecting the signal power
+func runDigitalScan(scan *Scan, resumeFrequency uint64) (err error) {
+	if resumeFrequency != 0 && !isScanFrequency(scan, resumeFrequency) {
+		log.Printf("scan %s: resume frequency %d not in the scan anymore - starting from the first frequency", scan.Name, resumeFrequency)
+		resumeFrequency = 0
+	}
+	done := make(chan struct{})
+	defer close(done)
+	for freqAndIdx := range getScanFrequenciesAndIndexes(scan, done) {
+		freq := freqAndIdx.frequency
+		if resumeFrequency != 0 {
+			if freq != resumeFrequency {
+				continue
+			}
+			resumeFrequency = 0
+		}
+		scan.CurrentFrequency = freq
+		if lockedOutFrequencies[freq] {
+			continue
+		}
+		if freq != sdrconnectSettings.DeviceCenterFrequency {
+			err = setCenterFrequency(freq)
+			if err != nil {
+				return
+			}
+		}
+		// give the decoder time to acquire the ensemble
+		clearReceiveStats()
+		err = setVFOFrequencyAndGetSignalStats(freq, scan.DetectTime)
+		if err != nil {
+			return
+		}
+		var fields []string
+		for _, property := range scan.DigitalProperties {
+			var value string
+			value, err = getSdrconnectProperty(property)
+			// a property that is not available on this channel is
+			// skipped, any other error ends the scan
+			if errors.Is(err, ErrPropertyRejected) || isTimeoutError(err) {
+				if debug {
+					log.Printf("digital property %s at %d: %v", property, freq, err)
+				}
+				err = nil
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if value != "" {
+				fields = append(fields, fmt.Sprintf("%s=%s", property, value))
+			}
+		}
+		if len(fields) == 0 {
+			if debug {
+				log.Printf("no digital metadata at %d", freq)
+			}
+			continue
+		}
+		showLine(scan, append([]string{"digital", "f=" + formatFrequency(scan, freq)}, fields...))
+	}
+	return
+}
+
+// filterRDSPSByDominantPI discards the PS fragments received while a PI
+// other than the most frequent one was present (e.g. adjacent channel
+// bleed), so the PS doesn't mix different stations
+func filterRDSPSByDominantPI() {
+	rdsPICount := make(map[uint16]int)
+	for _, rdsPI := range receiveStats.rdsPI {
+		rdsPICount[rdsPI]++
+	}
+	if len(rdsPICount) < 2 {
+		return
+	}
+	var dominantPI uint16
+	for rdsPI, count := range rdsPICount {
+		if count > rdsPICount[dominantPI] {
+			dominantPI = rdsPI
+		}
+	}
+	var rdsPS []string
+	var rdsPSPI []uint16
+	for idx, ps := range receiveStats.rdsPS {
+		pi := receiveStats.rdsPSPI[idx]
+		if pi == 0 || pi == dominantPI {
+			rdsPS = append(rdsPS, ps)
+			rdsPSPI = append(rdsPSPI, pi)
+		}
+	}
+	receiveStats.rdsPS = append(receiveStats.rdsPS[:0], rdsPS...)
+	receiveStats.rdsPSPI = append(receiveStats.rdsPSPI[:0], rdsPSPI...)
+}
+
+// auxiliary functions
+func clearReceiveStats() {
+	receiveStats.countMessages = 0
+	receiveStats.signalPower = receiveStats.signalPower[:0]
+	receiveStats.signalPowerTime = receiveStats.signalPowerTime[:0]
+	receiveStats.signalSNR = receiveStats.signalSNR[:0]
+	receiveStats.rdsPI = receiveStats.rdsPI[:0]
+	receiveStats.rdsPS = receiveStats.rdsPS[:0]
+	receiveStats.rdsPSPI = receiveStats.rdsPSPI[:0]
+	receiveStats.rdsTime = receiveStats.rdsTime[:0]
+	receiveStats.stereoPilot = false
+	receiveStats.squelchOpen = false
+	receiveStats.detectTrigger = ""
+}
+
+func countTrue(values ...bool) (count int) {
+	for _, value := range values {
+		if value {
+			count++
+		}
+	}
+	return
+}
+
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func restoreSdrconnectSettings(original SDRconnectSettings) {
+	setCenterFrequency(original.DeviceCenterFrequency)
+	setSdrconnectProperty("device_vfo_frequency", strconv.FormatUint(original.DeviceVFOFrequency, 10))
+	setSdrconnectProperty("demodulator", original.Demodulator.String())
+	setSdrconnectProperty("device_sample_rate", strconv.FormatFloat(original.SampleRate, 'f', -1, 64))
+	setSdrconnectProperty("audio_mute", strconv.FormatBool(original.AudioMute))
+}
+
+// config file
+func getStringConfigSetting(setting string, section *ini.Section) (value string, ok bool, err error) {
+	if section.HasKey(setting) {
+		value = section.Key(setting).String()
+		ok = true
+	} else if defaultSection.HasKey(setting) {
+		value = defaultSection.Key(setting).String()
+		ok = true
+	}
+	return
+}
+
+func getUint32ConfigSetting(setting string, section *ini.Section) (value uint32, ok bool, err error) {
+	var valueUint uint
+	if section.HasKey(setting) {
+		valueUint, err = section.Key(setting).Uint()
+		ok = true
+	} else if defaultSection.HasKey(setting) {
+		valueUint, err = defaultSection.Key(setting).Uint()
+		ok = true
+	}
+	if err == nil {
+		value = uint32(valueUint)
+	}
+	return
+}
+
+func getUint64ConfigSetting(setting string, section *ini.Section) (value uint64, ok bool, err error) {
+	if section.HasKey(setting) {
+		value, err = section.Key(setting).Uint64()
+		ok = true
+	} else if defaultSection.HasKey(setting) {
+		value, err = defaultSection.Key(setting).Uint64()
+		ok = true
+	}
+	return
+}
+
+func getFloat64ConfigSetting(setting string, section *ini.Section) (value float64, ok bool, err error) {
+	if section.HasKey(setting) {
+		value, err = section.Key(setting).Float64()
+		ok = true
+	} else if defaultSection.HasKey(setting) {
+		value, err = defaultSection.Key(setting).Float64()
+		ok = true
+	}
+	return
+}
+
+func getBoolConfigSetting(setting string, section *ini.Section) (value bool, ok bool, err error) {
+	if section.HasKey(setting) {
+		value, err = section.Key(setting).Bool()
+		ok = true
+	} else if defaultSection.HasKey(setting) {
+		value, err = defaultSection.Key(setting).Bool()
+		ok = true
+	}
+	return
+}
+
+func getFloat64sConfigSetting(setting string, section *ini.Section) (values []float64, ok bool, err error) {
+	if section.HasKey(setting) {
+		values, err = section.Key(setting).StrictFloat64s(",")
+		ok = true
+	} else if defaultSection.HasKey(setting) {
+		values, err = defaultSection.Key(setting).StrictFloat64s(",")
+		ok = true
+	}
+	return
+}
+
+// SDRconnect via websocket interface
+func sendMessage(request *Message) (err error) {
+	err = wrapProtocolError(websocket.JSON.Send(ws, request))
+	return
+}
+
+func receiveMessage(message *Message) (err error) {
+	*message = Message{}
+	err = wrapProtocolError(websocket.JSON.Receive(ws, message))
+	if err == nil {
+		// surface the server side problems (device disconnected,
+		// profile apply failed, etc), wherever the message is received
+		switch message.EventType {
+		case "error", "log", "notification":
+			text := message.Value
+			if message.Property != "" {
+				text = message.Property + ": " + text
+			}
+			priorityLog.Printf("SDRconnect %s: %s", message.EventType, text)
+		}
+	}
+	return
+}
+
+// wrapProtocolError adds the matching sentinel error (if any), while
+// keeping the original error in the chain
+func wrapProtocolError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) {
+		return fmt.Errorf("%w: %w", ErrWebsocketClosed, err)
+	}
+	return err
+}
+
+func getSdrconnectProperty(property string) (value string, err error) {
+	request := Message{
+		EventType: "get_property",
+		Property:  property,
+	}
+	err = sendMessage(&request)
+	if err != nil {
+		return
+	}
+	var message Message
+	ws.SetReadDeadline(time.Now().Add(waitGetProperty))
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		err = receiveMessage(&message)
+		if err != nil {
+			err = fmt.Errorf("getSdrconnectProperty(%s): %w", property, err)
+			return
+		}
+		if message.EventType == "get_property_response" {
+			if message.Property == property {
+				value = message.Value
+				return
+			}
+		}
+		// for instance a property not supported by this SDRconnect version
+		if message.EventType == "error" && message.Property == property {
+			err = fmt.Errorf("%w: getSdrconnectProperty(%s): %s", ErrPropertyRejected, property, message.Value)
+			return
+		}
+	}
+}
+
+func setSdrconnectProperty(property string, value string) (actualValue string, changed bool, err error) {
+	request := Message{
+		EventType: "set_property",
+		Property:  property,
+		Value:     value,
+	}
+	err = sendMessage(&request)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	var message Message
+	ws.SetReadDeadline(time.Now().Add(waitSetProperty))
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		err = receiveMessage(&message)
 		if err != nil {
-			return nil, err
+			// ignore timeouts because the property might already
+			// have been at the correct value (unless verify sets is on)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				actualValue = value
+				err = nil
+				if verifySets {
+					actualValue, err = verifySdrconnectProperty(property, value)
+				}
+			} else {
+				err = fmt.Errorf("setSdrconnectProperty(%s): %w", property, err)
+			}
+			return
 		}
-		var listenExtraTimeRDS time.Duration
-		if ok {
-			listenTimeRDS := time.Duration(listenTimeRDSMs) * time.Millisecond
-			if listenTimeRDS < listenTime {
-				err = fmt.Errorf("listen time rds should be greater than or equal to listen time")
-				return nil, err
+		if debug {
+			log.Println("message:", message.EventType, message.Property, message.Value)
+		}
+		if message.EventType == "property_changed" {
+			if message.Property == property {
+				actualValue = message.Value
+				changed = true
+				observeLatency(&setPropertyLatency, time.Since(start))
+				return
 			}
-			listenExtraTimeRDS = listenTimeRDS - listenTime
 		}
-		loOffsetFloat, ok, err := getFloat64ConfigSetting("lo offset", section)
-		if err != nil {
-			return nil, err
+	}
+}
+
+// verifySdrconnectProperty reads back a property whose set timed out
+// and returns an error if it doesn't have the requested value
+func verifySdrconnectProperty(property string, value string) (actualValue string, err error) {
+	actualValue, err = getSdrconnectProperty(property)
+	if err != nil {
+		return
+	}
+	if !samePropertyValue(actualValue, value) {
+		err = fmt.Errorf("%w: error setting %s - requested: %s - actual: %s", ErrPropertyRejected, property, value, actualValue)
+	}
+	return
+}
+
+// samePropertyValue compares two property values, numerically or as
+// booleans when possible, since SDRconnect might format them differently
+func samePropertyValue(a string, b string) bool {
+	if af, err := strconv.ParseFloat(a, 64); err == nil {
+		if bf, err := strconv.ParseFloat(b, 64); err == nil {
+			return af == bf
+		}
+	}
+	if ab, err := strconv.ParseBool(a); err == nil {
+		if bb, err := strconv.ParseBool(b); err == nil {
+			return ab == bb
 		}
-		loOffset := int32(loOffsetFloat)
+	}
+	return strings.EqualFold(a, b)
+}
 
-		// SDRconnect properties
-		sampleRate, ok, err := getFloat64ConfigSetting("sample rate", section)
-		if err != nil {
-			return nil, err
+// setSdrconnectProperties sends all the set_property requests at once and
+// then waits for the combined property_changed echoes, instead of waiting
+// for each property in turn
+func setSdrconnectProperties(properties []PropertyValue) (actualValues map[string]string, err error) {
+	actualValues = make(map[string]string)
+	if len(properties) == 0 {
+		return
+	}
+	pending := make(map[string]bool)
+	for _, property := range properties {
+		request := Message{
+			EventType: "set_property",
+			Property:  property.property,
+			Value:     property.value,
 		}
-		demodulatorString, ok, err := getStringConfigSetting("demodulator", section)
+		err = sendMessage(&request)
 		if err != nil {
-			return nil, err
+			return
 		}
-		var demodulator DemodulatorMode
-		if ok {
-			demodulator, err = ParseDemodulatorMode(demodulatorString)
-			if err != nil {
-				return nil, err
+		// like in setSdrconnectProperty, a property that doesn't change
+		// is assumed to already be at the requested value
+		actualValues[property.property] = property.value
+		pending[property.property] = true
+	}
+	var message Message
+	ws.SetReadDeadline(time.Now().Add(waitSetProperty))
+	defer ws.SetReadDeadline(time.Time{})
+	for len(pending) > 0 {
+		err = receiveMessage(&message)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = nil
+				if verifySets {
+					for property := range pending {
+						actualValues[property], err = verifySdrconnectProperty(property, actualValues[property])
+						if err != nil {
+							return
+						}
+					}
+				}
+			} else {
+				err = fmt.Errorf("setSdrconnectProperties: %w", err)
 			}
+			return
 		}
-		lnaState, ok, err := getUint32ConfigSetting("lna state", section)
-		if err != nil {
-			return nil, err
+		if debug {
+			log.Println("message:", message.EventType, message.Property, message.Value)
 		}
-		lnaStateSet := ok
-		squelchThreshold, ok, err := getFloat64ConfigSetting("squelch", section)
+		if message.EventType == "property_changed" && pending[message.Property] {
+			actualValues[message.Property] = message.Value
+			delete(pending, message.Property)
+		}
+	}
+	return
+}
+
+// selectDevice selects the device and verifies that it was actually
+// selected by reading back the property with its name or serial, retrying
+// the selection up to DeviceSelectRetries times; if SDRconnect doesn't
+// answer the property, the selection can't be verified
+func selectDevice(scan *Scan, property string, device string, selectFunc func(string) error) (err error) {
+	for attempt := uint32(0); ; attempt++ {
+		err = selectFunc(device)
 		if err != nil {
-			return nil, err
+			return
+		}
+		if deviceSelectUnverifiable {
+			return
+		}
+		var actualDevice string
+		actualDevice, err = getSdrconnectProperty(property)
+		if isTimeoutError(err) {
+			priorityLog.Printf("warning: the selected device cannot be verified (no %s property)", property)
+			deviceSelectUnverifiable = true
+			err = nil
+			return
 		}
-		squelchEnable := ok
-		agcThreshold, ok, err := getFloat64ConfigSetting("agc", section)
 		if err != nil {
-			return nil, err
+			return
 		}
-		agcEnable := ok
+		if actualDevice == device {
+			return
+		}
+		if attempt >= scan.DeviceSelectRetries {
+			err = fmt.Errorf("%w: error selecting device - requested: %s - actual: %s", ErrPropertyRejected, device, actualDevice)
+			return
+		}
+		log.Printf("device selection not confirmed (requested: %s - actual: %s) - retrying", device, actualDevice)
+	}
+}
 
-		scans = append(scans, Scan{
-			Start:                freqStart,
-			Stop:                 freqStop,
-			Step:                 freqStep,
-			List:                 freqList,
-			DeviceName:           deviceName,
-			DeviceSerial:         deviceSerial,
-			Profile:              profile,
-			DetectPowerThreshold: detectPowerThreshold,
-			DetectSNRThreshold:   detectSNRThreshold,
-			DetectTime:           detectTime,
-			ListenTime:           listenTime,
-			ListenExtraTimeRDS:   listenExtraTimeRDS,
-			LOOffset:             loOffset,
-			SampleRate:           sampleRate,
-			Demodulator:          demodulator,
-			LNAStateSet:          lnaStateSet,
-			LNAState:             lnaState,
-			SquelchEnable:        squelchEnable,
-			SquelchThreshold:     squelchThreshold,
-			AGCEnable:            agcEnable,
-			AGCThreshold:         agcThreshold,
-		})
+func selectSdrconnectDeviceByName(device_name string) (err error) {
+	request := Message{
+		EventType: "selected_device_name",
+		Value:     device_name,
+	}
+	err = sendMessage(&request)
+	if err != nil {
+		return
 	}
+	err = receiveMessages(&sdrconnectSettings, "select device", nil, waitSelectDevice)
 	return
 }
 
-func readLabelFile(labelFile string) (err error) {
-	var file *os.File
-	file, err = os.Open(labelFile)
+func selectSdrconnectDeviceBySerial(device_serial string) (err error) {
+	request := Message{
+		EventType: "selected_device_serial",
+		Value:     device_serial,
+	}
+	err = sendMessage(&request)
 	if err != nil {
 		return
 	}
-	defer file.Close()
+	err = receiveMessages(&sdrconnectSettings, "select device", nil, waitSelectDevice)
+	return
+}
 
-	reader := csv.NewReader(file)
-	reader.Comment = '#'
+func applySdrconnectProfile(profile string) (err error) {
+	request := Message{
+		EventType: "apply_device_profile",
+		Value:     profile,
+	}
+	err = sendMessage(&request)
+	if err != nil {
+		return
+	}
+	// fv
+	//err = receiveMessages(&sdrconnectSettings, "apply profile", regexp.MustCompile("^.*VCVC$"), waitApplyProfile)
+	err = receiveMessages(&sdrconnectSettings, "apply profile", nil, waitApplyProfile)
+	return
+}
 
-	for {
-		var record []string
-		record, err = reader.Read()
-		if err == io.EOF {
-			err = nil
-			break
+// receiveMessages receives the messages from SDRconnect for the given
+// purpose (detect, listen, select device, etc), which is shown in the
+// errors, until the sequence pattern is matched or the timeout expires
+func receiveMessages(settings *SDRconnectSettings, purpose string, sequencePattern *regexp.Regexp, timeout time.Duration) (err error) {
+	var message Message
+	var sequence string
+	// a repeated echo of the same property change (same property and
+	// value as the previous step) doesn't extend the sequence, so it can't
+	// match the sequence pattern prematurely
+	var lastProperty, lastValue string
+	addToSequence := func(step string) {
+		if sequence != "" && message.Property == lastProperty && message.Value == lastValue {
+			return
 		}
+		lastProperty = message.Property
+		lastValue = message.Value
+		sequence += step
+	}
+	var paused bool
+	ws.SetReadDeadline(time.Now().Add(timeout))
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		err = receiveMessage(&message)
 		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && sequencePattern == nil && receiveStats.countMessages > 0 {
+				err = nil
+			} else {
+				err = fmt.Errorf("receive messages (%s): %w", purpose, err)
+			}
 			return
 		}
-		if len(record) != 2 {
-			err = fmt.Errorf("invalid label record: %v", record)
+		receiveStats.countMessages++
+		if debug {
+			log.Println("message:", purpose, message.EventType, message.Property, message.Value)
+		}
+
+		// handle user commands
+		if userCommandTerminate {
+			userCommandTerminate = false
+			err = ErrUserCommandTerminate
+			return
+		} else if userCommandNextScan {
+			userCommandNextScan = false
+			err = ErrUserCommandNextScan
+			return
+		} else if userCommandTogglePause {
+			userCommandTogglePause = false
+			if !paused {
+				ws.SetReadDeadline(time.Time{})
+			} else {
+				ws.SetReadDeadline(time.Now())
+			}
+			paused = !paused
+		} else if userCommandLockout {
+			userCommandLockout = false
+			lockedOutFrequencies[settings.DeviceVFOFrequency] = true
+			log.Printf("frequency %d locked out", settings.DeviceVFOFrequency)
+		} else if userCommandStep != 0 && manualStep {
+			err = ErrUserCommandStep
+			return
+		} else if userCommandJump != 0 && scanning {
+			err = ErrUserCommandJump
 			return
 		}
-		var key uint64
-		if len(record[0]) == 4 {
-			// PI code
-			key, err = strconv.ParseUint(record[0], 16, 16)
-		} else {
-			// frequency
-			key, err = strconv.ParseUint(record[0], 10, 64)
+
+		if message.EventType == "property_changed" {
+			switch message.Property {
+			case "device_sample_rate":
+				settings.SampleRate, _ = strconv.ParseFloat(message.Value, 64)
+				addToSequence("S")
+			case "device_vfo_frequency":
+				settings.DeviceVFOFrequency, _ = strconv.ParseUint(message.Value, 10, 64)
+				lastVFOFrequencyChange = time.Now()
+				addToSequence("V")
+			case "device_center_frequency":
+				settings.DeviceCenterFrequency, _ = strconv.ParseUint(message.Value, 10, 64)
+				addToSequence("C")
+			case "filter_bandwidth":
+				filterBandwidth, _ := strconv.ParseUint(message.Value, 10, 32)
+				settings.FilterBandwidth = uint32(filterBandwidth)
+				addToSequence("F")
+			case "signal_power":
+				if len(receiveStats.signalPower) < cap(receiveStats.signalPower) {
+					signalPower, _ := strconv.ParseFloat(message.Value, 64)
+					receiveStats.signalPower = append(receiveStats.signalPower, signalPower)
+					receiveStats.signalPowerTime = append(receiveStats.signalPowerTime, time.Now())
+				}
+			case "signal_snr":
+				if len(receiveStats.signalSNR) < cap(receiveStats.signalSNR) {
+					signalSNR, _ := strconv.ParseFloat(message.Value, 64)
+					receiveStats.signalSNR = append(receiveStats.signalSNR, signalSNR)
+				}
+			case "stereo_pilot":
+				if stereoPilot, _ := strconv.ParseBool(message.Value); stereoPilot {
+					receiveStats.stereoPilot = true
+				}
+			case "squelch_open", "squelch_status":
+				// latched, so a short squelch opening during the
+				// detect time is still a detection
+				if message.Value == "open" {
+					receiveStats.squelchOpen = true
+				} else if squelchOpen, _ := strconv.ParseBool(message.Value); squelchOpen {
+					receiveStats.squelchOpen = true
+				}
+			case "rds_pi":
+				if len(receiveStats.rdsPI) < cap(receiveStats.rdsPI) {
+					rdsPI, _ := strconv.ParseUint(message.Value, 10, 16)
+					if rdsPI != 0 {
+						receiveStats.rdsPI = append(receiveStats.rdsPI, uint16(rdsPI))
+						addRDSTime()
+					}
+				}
+			case "rds_ps":
+				if len(receiveStats.rdsPS) < cap(receiveStats.rdsPS) {
+					rdsPS := strings.TrimSpace(message.Value)
+					if rdsPS != "" {
+						receiveStats.rdsPS = append(receiveStats.rdsPS, rdsPS)
+						// the PI received last, to associate the PS to a station
+						var rdsPI uint16
+						if len(receiveStats.rdsPI) > 0 {
+							rdsPI = receiveStats.rdsPI[len(receiveStats.rdsPI)-1]
+						}
+						receiveStats.rdsPSPI = append(receiveStats.rdsPSPI, rdsPI)
+						addRDSTime()
+					}
+				}
+			// SDRconnect properties
+			case "demodulator":
+				settings.Demodulator, _ = ParseDemodulatorMode(message.Value)
+			case "lna_state":
+				lnaState, _ := strconv.ParseUint(message.Value, 0, 32)
+				settings.LNAState = uint32(lnaState)
+			case "antenna_select":
+				settings.Antenna = message.Value
+			case "bias_tee_enable":
+				settings.BiasTee, _ = strconv.ParseBool(message.Value)
+				settings.BiasTeeKnown = true
+			case "squelch_enable":
+				settings.SquelchEnable, _ = strconv.ParseBool(message.Value)
+			case "squelch_threshold":
+				settings.SquelchThreshold, _ = strconv.ParseFloat(message.Value, 64)
+			case "agc_enable":
+				settings.AGCEnable, _ = strconv.ParseBool(message.Value)
+			case "agc_threshold":
+				settings.AGCThreshold, _ = strconv.ParseFloat(message.Value, 64)
+			case "audio_mute":
+				settings.AudioMute, _ = strconv.ParseBool(message.Value)
+			}
+			if sequencePattern != nil && sequencePattern.MatchString(sequence) {
+				break
+			}
 		}
+	}
+	return
+}
+
+func setCenterFrequency(loFreq uint64) (err error) {
+	request := Message{
+		EventType: "set_property",
+		Property:  "device_center_frequency",
+		Value:     strconv.FormatUint(loFreq, 10),
+	}
+	err = sendMessage(&request)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	// the sequence might also match on a stale echo of a previous center
+	// frequency change, so the final state is checked as well
+	deadline := start.Add(waitSetCenterFrequency)
+	for {
+		err = receiveMessages(&sdrconnectSettings, "set center frequency", regexp.MustCompile("^.*CV$"), time.Until(deadline))
 		if err != nil {
 			return
 		}
-		label := strings.TrimSpace(record[1])
-		currentLabel, ok := labels[key]
-		if ok {
-			labels[key] = currentLabel + "|" + label
-		} else {
-			labels[key] = label
+		if sdrconnectSettings.DeviceCenterFrequency == loFreq || !time.Now().Before(deadline) {
+			break
 		}
 	}
+	observeLatency(&setCenterFrequencyLatency, time.Since(start))
+	if sdrconnectSettings.DeviceCenterFrequency != loFreq {
+		err = fmt.Errorf("%w: error setting center frequency - requested: %d - actual: %d", ErrPropertyRejected, loFreq, sdrconnectSettings.DeviceCenterFrequency)
+	}
 	return
 }
 
-func getSdrconnectSettings() (settings SDRconnectSettings, err error) {
-	var result string
-	result, err = getSdrconnectProperty("device_sample_rate")
-	if err != nil {
+func setAudioMute(mute bool) (err error) {
+	if mute == sdrconnectSettings.AudioMute {
 		return
 	}
-	settings.SampleRate, err = strconv.ParseFloat(result, 64)
+	_, _, err = setSdrconnectProperty("audio_mute", strconv.FormatBool(mute))
 	if err != nil {
 		return
 	}
+	sdrconnectSettings.AudioMute = mute
+	return
+}
 
-	result, err = getSdrconnectProperty("filter_bandwidth")
-	if err != nil {
+func setSquelchEnable(enable bool) (err error) {
+	if enable == sdrconnectSettings.SquelchEnable {
 		return
 	}
-	var filterBandwidth uint64
-	filterBandwidth, err = strconv.ParseUint(result, 10, 32)
+	_, _, err = setSdrconnectProperty("squelch_enable", strconv.FormatBool(enable))
 	if err != nil {
 		return
 	}
-	settings.FilterBandwidth = uint32(filterBandwidth)
+	sdrconnectSettings.SquelchEnable = enable
+	return
+}
 
-	// SDRconnect properties
-	result, err = getSdrconnectProperty("demodulator")
-	if err != nil {
-		return
+func setVFOFrequencyAndGetSignalStats(freq uint64, detectTime time.Duration) (err error) {
+	request := Message{
+		EventType: "set_property",
+		Property:  "device_vfo_frequency",
+		Value:     strconv.FormatUint(freq, 10),
 	}
-	settings.Demodulator, err = ParseDemodulatorMode(result)
+	err = sendMessage(&request)
 	if err != nil {
 		return
 	}
-	result, err = getSdrconnectProperty("lna_state")
+	start := time.Now()
+	err = receiveMessages(&sdrconnectSettings, "set VFO frequency", nil, detectTime)
 	if err != nil {
 		return
 	}
-	var lnaState uint64
-	lnaState, err = strconv.ParseUint(result, 10, 32)
-	if err != nil {
-		return
+	if lastVFOFrequencyChange.After(start) {
+		observeLatency(&setVFOFrequencyLatency, lastVFOFrequencyChange.Sub(start))
 	}
-	settings.LNAState = uint32(lnaState)
-	result, err = getSdrconnectProperty("squelch_enable")
-	if err != nil {
-		return
+	if sdrconnectSettings.DeviceVFOFrequency != freq {
+		err = fmt.Errorf("%w: error setting VFO frequency - requested: %d - actual: %d", ErrPropertyRejected, freq, sdrconnectSettings.DeviceVFOFrequency)
 	}
-	settings.SquelchEnable, err = strconv.ParseBool(result)
-	if err != nil {
+	return
+}
+
+// adaptive waits
+// after adaptiveWaitSamples operations, the wait is reduced to the
+// maximum observed latency times a safety margin
+func observeLatency(latencyTracker *LatencyTracker, latency time.Duration) {
+	if !adaptiveWaits || latencyTracker.count >= adaptiveWaitSamples {
 		return
 	}
-	result, err = getSdrconnectProperty("squelch_threshold")
-	if err != nil {
+	latencyTracker.count++
+	latencyTracker.maxLatency = max(latencyTracker.maxLatency, latency)
+	if latencyTracker.count < adaptiveWaitSamples {
 		return
 	}
-	settings.SquelchThreshold, err = strconv.ParseFloat(result, 64)
-	if err != nil {
+	if latencyTracker.wait == nil {
+		log.Printf("adaptive waits: %s - max latency: %v", latencyTracker.name, latencyTracker.maxLatency)
 		return
 	}
-	result, err = getSdrconnectProperty("agc_enable")
-	if err != nil {
-		return
+	wait := max(time.Duration(adaptiveWaitMargin)*latencyTracker.maxLatency, adaptiveWaitMin)
+	if wait < *latencyTracker.wait {
+		*latencyTracker.wait = wait
 	}
-	settings.AGCEnable, err = strconv.ParseBool(result)
-	if err != nil {
-		return
+	log.Printf("adaptive waits: %s - max latency: %v - wait: %v", latencyTracker.name, latencyTracker.maxLatency, *latencyTracker.wait)
+}
+
+// other useful functions
+// the IF bandwidths (in kHz) are the SDRplay ones, unless the scan
+// has its own table
+var defaultIFBandwidthskHz = []uint32{200, 300, 600, 1536, 5000, 6000, 7000, 8000}
+
+func getIFBandwidth(scan *Scan, sampleRate float64) uint32 {
+	bandwidthskHz := defaultIFBandwidthskHz
+	if len(scan.IFBandwidthskHz) > 0 {
+		bandwidthskHz = scan.IFBandwidthskHz
 	}
-	result, err = getSdrconnectProperty("agc_threshold")
-	if err != nil {
-		return
+
+	rate := uint32(sampleRate / 1000)
+	prevBandwidth := bandwidthskHz[0]
+	for _, bandwidth := range bandwidthskHz {
+		if rate < bandwidth {
+			return prevBandwidth * 1000
+		}
+		prevBandwidth = bandwidth
+	}
+	return prevBandwidth * 1000
+}
+
+func computeLOSpans(scan *Scan) (err error) {
+	if scan.LOOffsetPercent != 0 {
+		scan.LOOffset = int32(scan.LOOffsetPercent / 100 * float64(getIFBandwidth(scan, sdrconnectSettings.SampleRate)))
 	}
-	settings.AGCThreshold, err = strconv.ParseFloat(result, 64)
+	scan.LOSpans = getLOSpans(scan)
+	scan.LOSpansFilterBandwidth = sdrconnectSettings.FilterBandwidth
+	err = checkLOSpans(scan)
 	if err != nil {
 		return
 	}
+	showLOSpanStats(scan)
+	return
+}
 
-	result, err = getSdrconnectProperty("device_center_frequency")
-	if err != nil {
-		return
+// showLOSpanStats logs how many frequencies are in each LO span, and warns
+// if the spans are too small (i.e. too many retunes), which suggests that
+// the IF bandwidth or the frequency step are poorly matched
+func showLOSpanStats(scan *Scan) {
+	minCount := math.MaxInt
+	maxCount := 0
+	total := 0
+	for _, loSpan := range scan.LOSpans {
+		count := loSpan.to - loSpan.from + 1
+		minCount = min(minCount, count)
+		maxCount = max(maxCount, count)
+		total += count
 	}
-	settings.DeviceCenterFrequency, err = strconv.ParseUint(result, 10, 64)
-	if err != nil {
-		return
+	avgCount := float64(total) / float64(len(scan.LOSpans))
+	log.Printf("scan %s: %d LO spans - frequencies per span: min=%d max=%d avg=%.1f", scan.Name, len(scan.LOSpans), minCount, maxCount, avgCount)
+	if scan.MinSpanFrequencies > 0 && len(scan.LOSpans) > 1 && avgCount < float64(scan.MinSpanFrequencies) {
+		log.Printf("scan %s: the LO spans have %.1f frequencies on average (less than %d) - consider a higher sample rate or a different frequency step", scan.Name, avgCount, scan.MinSpanFrequencies)
 	}
+}
 
-	result, err = getSdrconnectProperty("device_vfo_frequency")
-	if err != nil {
-		return
+// checkLOSpans verifies that the LO spans cover all the scan frequency
+// indexes in sequence with no gaps or overlaps
+func checkLOSpans(scan *Scan) (err error) {
+	count := getScanFrequencyCount(scan)
+	var nextFrom int
+	for idx, loSpan := range scan.LOSpans {
+		if loSpan.from != nextFrom || loSpan.to < loSpan.from {
+			err = fmt.Errorf("invalid LO span #%d: from=%d to=%d - expected from=%d", idx, loSpan.from, loSpan.to, nextFrom)
+			return
+		}
+		nextFrom = loSpan.to + 1
 	}
-	settings.DeviceVFOFrequency, err = strconv.ParseUint(result, 10, 64)
-	if err != nil {
+	if nextFrom != count {
+		err = fmt.Errorf("LO spans cover %d frequencies out of %d", nextFrom, count)
 		return
 	}
+	// every frequency must be within the passband of its span center
+	// frequency, whatever the order of the frequencies
+	done := make(chan struct{})
+	defer close(done)
+	loIdx := 0
+	for freqAndIdx := range getScanFrequenciesAndIndexes(scan, done) {
+		for freqAndIdx.index > scan.LOSpans[loIdx].to {
+			loIdx++
+		}
+		loFrequency := scan.LOSpans[loIdx].frequency
+		if !isServedByLOFrequency(scan, freqAndIdx.frequency, loFrequency) {
+			err = fmt.Errorf("frequency %d is outside of LO span #%d (LO frequency=%d)", freqAndIdx.frequency, loIdx, loFrequency)
+			return
+		}
+	}
+	return
+}
 
+func getScanFrequencyCount(scan *Scan) (count int) {
+	done := make(chan struct{})
+	defer close(done)
+	for range getScanFrequenciesAndIndexes(scan, done) {
+		count++
+	}
 	return
 }
 
-func getKeyPresses() {
-	for {
-		char, key, err := keyboard.GetKey()
-		if err != nil {
-			log.Fatal(err)
-		}
-		if key == keyboard.KeyCtrlC || char == 'q' || char == 'Q' {
-			userCommandTerminate = true
-			break
-		} else if key == keyboard.KeySpace {
-			userCommandTogglePause = true
-		} else if char == 'n' || char == 'N' {
-			userCommandNextScan = true
-		}
+// snapFrequency rounds the frequency to the nearest multiple of the grid
+func snapFrequency(frequency uint64, grid uint64) uint64 {
+	if grid == 0 {
+		return frequency
 	}
+	return (frequency + grid/2) / grid * grid
 }
 
-func initScan(scan *Scan) (err error) {
-	if scan.DeviceName != "" {
-		if scan.DeviceName != sdrconnectSettings.DeviceName {
-			err = selectSdrconnectDeviceByName(scan.DeviceName)
-			if err != nil {
-				return
-			}
-			sdrconnectSettings.DeviceName = scan.DeviceName
+func getLOSpans(scan *Scan) (loSpans []LOSpan) {
+	maxDf := getMaxLOSpanWidth(scan)
+	var fmin uint64 = math.MaxUint64
+	var fmax uint64 = 0
+	flo := (fmin + fmax) / 2
+	var idxFrom int
+	var idxTo int
+	done := make(chan struct{})
+	defer close(done)
+	for freqAndIdx := range getScanFrequenciesAndIndexes(scan, done) {
+		freq := freqAndIdx.frequency
+		idx := freqAndIdx.index
+		fmin = min(fmin, freq)
+		fmax = max(fmax, freq)
+		df := fmax - fmin
+		if df > maxDf {
+			loSpans = append(loSpans, LOSpan{
+				from:      idxFrom,
+				to:        idxTo,
+				frequency: uint64(int64(flo) + int64(scan.LOOffset)),
+			})
+			idxFrom = idx
+			fmin = freq
+			fmax = freq
 		}
-	} else if scan.DeviceSerial != "" {
-		if scan.DeviceSerial != sdrconnectSettings.DeviceSerial {
-			err = selectSdrconnectDeviceBySerial(scan.DeviceSerial)
-			if err != nil {
-				return
-			}
-			sdrconnectSettings.DeviceSerial = scan.DeviceSerial
+		flo = (fmin + fmax) / 2
+		idxTo = idx
+	}
+	loSpans = append(loSpans, LOSpan{
+		from:      idxFrom,
+		to:        idxTo,
+		frequency: uint64(int64(flo) + int64(scan.LOOffset)),
+	})
+	return
+}
+
+// getMaxLOSpanWidth returns the maximum frequency range that can be
+// covered by a single center frequency; with fine search, room is left
+// for the probe offsets on both sides, so they stay within the IF
+func getMaxLOSpanWidth(scan *Scan) uint64 {
+	width := int64(getIFBandwidth(scan, sdrconnectSettings.SampleRate)) -
+		int64(sdrconnectSettings.FilterBandwidth) -
+		int64(max(scan.LOOffset, -scan.LOOffset)) -
+		2*int64(scan.FineSearch)
+	return uint64(max(width, 0))
+}
+
+// isServedByLOFrequency returns true if the frequency is within the range
+// covered by the center frequency loFrequency
+func isServedByLOFrequency(scan *Scan, frequency uint64, loFrequency uint64) bool {
+	flo := int64(loFrequency) - int64(scan.LOOffset)
+	df := int64(frequency) - flo
+	// rounded up since the span center frequency is rounded down
+	return uint64(max(df, -df)) <= (getMaxLOSpanWidth(scan)+1)/2
+}
+
+func getSignalMax(samples []float64) (signalMax float64) {
+	switch len(samples) {
+	case 0:
+		signalMax = -1000
+	case 1:
+		signalMax = samples[0]
+	default:
+		// ignore the first element since it might be tainted
+		// by the previous frequency
+		signalMax = slices.Max(samples[1:])
+	}
+	return
+}
+
+// getSmoothedSignalMax returns the peak of the exponential moving average
+// of the samples, so single sample spikes are suppressed while sustained
+// signals are tracked
+func getSmoothedSignalMax(samples []float64, alpha float64) (signalMax float64) {
+	if len(samples) > 1 {
+		// ignore the first element since it might be tainted
+		// by the previous frequency
+		samples = samples[1:]
+	}
+	signalMax = -1000
+	var ema float64
+	for idx, sample := range samples {
+		if idx == 0 {
+			ema = sample
+		} else {
+			ema = alpha*sample + (1-alpha)*ema
 		}
+		signalMax = max(signalMax, ema)
 	}
-	if scan.Profile != sdrconnectSettings.Profile {
-		err = applySdrconnectProfile(scan.Profile)
-		if err != nil {
-			return
+	return
+}
+
+// detectSignal also returns the criterion that triggered the detection
+// (power, snr, power+snr, squelch, rds, always, or stereo)
+func detectSignal(scan *Scan) (signalDetected bool, trigger string) {
+	return evaluateSignal(scan, receiveStats.signalPower, receiveStats.signalSNR, scan.DetectTime)
+}
+
+// evaluateSignal applies the detection criteria to the signal power and
+// SNR samples collected during the period
+func evaluateSignal(scan *Scan, signalPower []float64, signalSNR []float64, period time.Duration) (signalDetected bool, trigger string) {
+	// like a traditional scanner, the squelch opening is the trigger
+	if scan.DetectMode == "squelch" {
+		return receiveStats.squelchOpen, "squelch"
+	}
+
+	// no signal power and SNR streamed by SDRconnect (e.g. for this mode)
+	if len(signalPower) == 0 && len(signalSNR) == 0 {
+		switch scan.DetectFallback {
+		case "rds":
+			return len(receiveStats.rdsPI) > 0, "rds"
+		case "always":
+			return true, "always"
 		}
-		sdrconnectSettings.Profile = scan.Profile
 	}
 
-	// set specific SDRconnect properties are requested
-	var result string
+	// a stereo pilot strongly implies a real FM broadcast
+	if scan.DetectStereoPilot && receiveStats.stereoPilot {
+		return true, "stereo"
+	}
 
-	if scan.SampleRate != 0 {
-		if scan.SampleRate != sdrconnectSettings.SampleRate {
-			sampleRate := strconv.FormatFloat(scan.SampleRate, 'f', -1, 64)
-			var actualSampleRate string
-			actualSampleRate, _, err = setSdrconnectProperty("device_sample_rate", sampleRate)
-			if err != nil {
-				return
-			}
-			sdrconnectSettings.SampleRate, err = strconv.ParseFloat(actualSampleRate, 64)
-			if err != nil {
-				return
-			}
+	var signalPowerMax, signalSNRMax float64
+	if scan.DetectSmoothingAlpha > 0 {
+		signalPowerMax = getSmoothedSignalMax(signalPower, scan.DetectSmoothingAlpha)
+		signalSNRMax = getSmoothedSignalMax(signalSNR, scan.DetectSmoothingAlpha)
+	} else {
+		signalPowerMax = getSignalMax(signalPower)
+		signalSNRMax = getSignalMax(signalSNR)
+	}
+	// the average over the detect time is not triggered by short
+	// noise spikes
+	if scan.DetectPowerMode == "average" && len(signalPower) > 0 {
+		signalPowerMax = getSignalAverage(signalPower)
+	}
+
+	// a lone sample is the one that might be tainted by the previous
+	// frequency, so it is not a reliable measurement
+	if !scan.DetectSingleSample {
+		if len(signalPower) < 2 {
+			signalPowerMax = -1000
+		}
+		if len(signalSNR) < 2 {
+			signalSNRMax = -1000
 		}
 	}
 
-	if scan.Demodulator != DemodulatorUnknown {
-		if scan.Demodulator != sdrconnectSettings.Demodulator {
-			var demodulator string
-			demodulator, _, err = setSdrconnectProperty("demodulator", scan.Demodulator.String())
-			if err != nil {
-				return
-			}
-			sdrconnectSettings.Demodulator, err = ParseDemodulatorMode(demodulator)
-			if err != nil {
-				return
-			}
+	powerThreshold, snrThreshold := getDetectThresholds(scan)
+	powerTriggered := signalPowerMax >= powerThreshold
+	snrTriggered := signalSNRMax >= snrThreshold
+	signalDetected = powerTriggered || snrTriggered
+	// a high SNR on near noise floor power is not a signal
+	if scan.DetectPowerFloorSet && signalPowerMax < scan.DetectPowerFloor {
+		signalDetected = false
+		return
+	}
+	// barely decodable fringe FM signals have a low RDS rate
+	if scan.DetectMinRDSRate > 0 && getRDSRate(period) < scan.DetectMinRDSRate {
+		signalDetected = false
+		return
+	}
+	switch {
+	case powerTriggered && snrTriggered:
+		trigger = "power+snr"
+	case powerTriggered:
+		trigger = "power"
+	case snrTriggered:
+		trigger = "snr"
+	}
+	return
+}
+
+// arrival times of the valid RDS PI and PS
+func addRDSTime() {
+	if len(receiveStats.rdsTime) < cap(receiveStats.rdsTime) {
+		receiveStats.rdsTime = append(receiveStats.rdsTime, time.Now())
+	}
+}
+
+// getRDSRate returns the number of valid RDS groups (PI or PS) received
+// per second during the last period
+func getRDSRate(period time.Duration) float64 {
+	if period <= 0 {
+		return 0
+	}
+	since := time.Now().Add(-period)
+	count := 0
+	for _, t := range receiveStats.rdsTime {
+		if !t.Before(since) {
+			count++
 		}
 	}
+	return float64(count) / period.Seconds()
+}
 
-	if scan.LNAStateSet {
-		if scan.LNAState != sdrconnectSettings.LNAState {
-			lnaState := strconv.FormatUint(uint64(scan.LNAState), 10)
-			_, _, err = setSdrconnectProperty("lna_state", lnaState)
-			if err != nil {
-				return
-			}
-			sdrconnectSettings.LNAState = scan.LNAState
+// waitForRDSPI confirms a detection only if an RDS PI is received, waiting
+// up to the 'detect require rds time' for it
+func waitForRDSPI(scan *Scan) (confirmed bool, err error) {
+	deadline := time.Now().Add(scan.DetectRequireRDSTime)
+	for len(receiveStats.rdsPI) == 0 {
+		wait := min(time.Until(deadline), 100*time.Millisecond)
+		if wait <= 0 {
+			return
+		}
+		err = receiveMessages(&sdrconnectSettings, "detect rds", nil, wait)
+		if err != nil {
+			return
 		}
 	}
+	confirmed = true
+	return
+}
 
-	if scan.SquelchEnable {
-		if scan.SquelchEnable != sdrconnectSettings.SquelchEnable {
-			_, _, err = setSdrconnectProperty("squelch_enable", "true")
-			if err != nil {
-				return
-			}
-			sdrconnectSettings.SquelchEnable = scan.SquelchEnable
+// recheckWithShiftedLO moves the LO by the filter bandwidth (so the signal
+// lands in a different part of the IF) and repeats the detection; a real
+// signal is still there, while a spur generated by the receiver itself
+// moves or disappears.
+// The original LO is restored before returning (also on errors), since
+// the scan loop sets the LO only at the start of each LO span
+func recheckWithShiftedLO(scan *Scan, freq uint64) (signalDetected bool, trigger string, err error) {
+	originalLOFreq := sdrconnectSettings.DeviceCenterFrequency
+	defer func() {
+		if sdrconnectSettings.DeviceCenterFrequency == originalLOFreq {
+			return
 		}
-		if scan.SquelchThreshold != sdrconnectSettings.SquelchThreshold {
-			squelchThreshold := strconv.FormatFloat(scan.SquelchThreshold, 'f', -1, 64)
-			_, _, err = setSdrconnectProperty("squelch_threshold", squelchThreshold)
-			if err != nil {
-				return
-			}
-			sdrconnectSettings.SquelchThreshold = scan.SquelchThreshold
+		restoreErr := setCenterFrequency(originalLOFreq)
+		if err == nil {
+			err = restoreErr
 		}
+	}()
+	loFreq := originalLOFreq
+	shift := uint64(sdrconnectSettings.FilterBandwidth)
+	// move the LO toward the signal, so it stays within the IF bandwidth
+	if freq >= loFreq {
+		loFreq += shift
+	} else {
+		loFreq -= shift
+	}
+	err = setCenterFrequency(loFreq)
+	if err != nil {
+		return
+	}
+	clearReceiveStats()
+	err = setVFOFrequencyAndGetSignalStats(freq, scan.DetectTime)
+	if err != nil {
+		return
+	}
+	signalDetected, trigger = detectSignal(scan)
+	return
+}
+
+// calibrateThresholds measures the noise floor and the SNR on a known
+// quiet reference frequency and sets the detect thresholds at a margin
+// above them
+func calibrateThresholds(scan *Scan) (err error) {
+	err = setCenterFrequency(scan.CalibrateFrequency)
+	if err != nil {
+		return
+	}
+	clearReceiveStats()
+	err = setVFOFrequencyAndGetSignalStats(scan.CalibrateFrequency, scan.CalibrateTime)
+	if err != nil {
+		return
+	}
+	signalPower := receiveStats.signalPower
+	signalSNR := receiveStats.signalSNR
+	// ignore the first element since it might be tainted
+	// by the previous frequency
+	if len(signalPower) > 1 {
+		signalPower = signalPower[1:]
+	}
+	if len(signalSNR) > 1 {
+		signalSNR = signalSNR[1:]
+	}
+	if len(signalPower) == 0 && len(signalSNR) == 0 {
+		err = fmt.Errorf("no signal power or SNR received on the calibration frequency %d", scan.CalibrateFrequency)
+		return
+	}
+	if len(signalPower) > 0 {
+		scan.DetectPowerThreshold = getMean(signalPower) + scan.CalibrateMargin
+	}
+	if len(signalSNR) > 0 {
+		scan.DetectSNRThreshold = getMean(signalSNR) + scan.CalibrateMargin
+	}
+	log.Printf("scan %s: calibrated on %d - detect power threshold=%.1fdB detect snr threshold=%.1fdB", scan.Name, scan.CalibrateFrequency, scan.DetectPowerThreshold, scan.DetectSNRThreshold)
+	return
+}
+
+func getMean(samples []float64) float64 {
+	var sum float64
+	for _, sample := range samples {
+		sum += sample
+	}
+	return sum / float64(len(samples))
+}
+
+// getDetectThresholds returns the detect thresholds for the active
+// demodulator mode, falling back to the scan thresholds
+func getDetectThresholds(scan *Scan) (powerThreshold float64, snrThreshold float64) {
+	powerThreshold = scan.DetectPowerThreshold
+	if threshold, ok := scan.DetectPowerThresholds[sdrconnectSettings.Demodulator]; ok {
+		powerThreshold = threshold
+	}
+	snrThreshold = scan.DetectSNRThreshold
+	if threshold, ok := scan.DetectSNRThresholds[sdrconnectSettings.Demodulator]; ok {
+		snrThreshold = threshold
+	}
+	return
+}
+
+// getSignalAverage returns the average (in dB) of the samples, computed
+// in linear scale; it is never higher than the peak
+func getSignalAverage(samples []float64) float64 {
+	// ignore the first element since it might be tainted
+	// by the previous frequency
+	if len(samples) > 1 {
+		samples = samples[1:]
+	}
+	var sum float64
+	for _, sample := range samples {
+		sum += math.Pow(10, sample/10)
 	}
+	return 10 * math.Log10(sum/float64(len(samples)))
+}
 
-	if scan.AGCEnable {
-		if scan.AGCEnable != sdrconnectSettings.AGCEnable {
-			_, _, err = setSdrconnectProperty("agc_enable", "true")
-			if err != nil {
-				return
-			}
-			sdrconnectSettings.AGCEnable = scan.AGCEnable
-		}
-		if scan.AGCThreshold != sdrconnectSettings.AGCThreshold {
-			agcThreshold := strconv.FormatFloat(scan.AGCThreshold, 'f', -1, 64)
-			_, _, err = setSdrconnectProperty("agc_threshold", agcThreshold)
-			if err != nil {
-				return
+// confirmSignal re-evaluates the detection with the same criteria as
+// detectSignal, using only the stats collected while listening
+func confirmSignal(scan *Scan, signalPowerFrom int, signalSNRFrom int, listenTime time.Duration) bool {
+	confirmed, _ := evaluateSignal(scan, receiveStats.signalPower[signalPowerFrom:], receiveStats.signalSNR[signalSNRFrom:], listenTime)
+	return confirmed
+}
+
+// analyzeCWKeying looks for on/off keying in the signal power collected
+// while listening, and estimates the speed from the shortest 'on' element
+// (a dit); the estimate is rough since it is limited by the rate at which
+// SDRconnect sends the signal power
+func analyzeCWKeying() (keying bool, wpm int) {
+	if len(receiveStats.signalPower) < 5 {
+		return
+	}
+	// ignore the first element since it might be tainted
+	// by the previous frequency
+	signalPower := receiveStats.signalPower[1:]
+	signalPowerTime := receiveStats.signalPowerTime[1:]
+	signalPowerMin := slices.Min(signalPower)
+	signalPowerMax := slices.Max(signalPower)
+	if signalPowerMax-signalPowerMin < cwKeyingMinDepth {
+		// steady carrier (or just noise)
+		return
+	}
+	threshold := (signalPowerMin + signalPowerMax) / 2
+	var on bool
+	var onStart time.Time
+	var elements int
+	var shortest time.Duration
+	for idx, power := range signalPower {
+		if power >= threshold && !on {
+			on = true
+			onStart = signalPowerTime[idx]
+		} else if power < threshold && on {
+			on = false
+			elements++
+			if d := signalPowerTime[idx].Sub(onStart); d > 0 && (shortest == 0 || d < shortest) {
+				shortest = d
 			}
-			sdrconnectSettings.AGCThreshold = scan.AGCThreshold
 		}
 	}
+	keying = elements >= 2
+	// no speed estimate (wpm = 0) if the shortest element is too short
+	// to be measured with the signal power timestamps
+	if keying && shortest >= time.Millisecond {
+		// PARIS standard: dit length in ms = 1200 / WPM
+		wpm = int(math.Round(1200 / (float64(shortest) / float64(time.Millisecond))))
+	}
+	return
+}
 
-	// make sure we know the current sample rate and filter bandwidth
-	if sdrconnectSettings.SampleRate == 0 {
-		result, err = getSdrconnectProperty("device_sample_rate")
-		if err != nil {
-			return
-		}
-		sdrconnectSettings.SampleRate, err = strconv.ParseFloat(result, 64)
-		if err != nil {
-			return
-		}
+// detection tracker
+func trackDetection(freq uint64, agingTime time.Duration) (isNew bool) {
+	now := time.Now()
+	detection, ok := trackedDetections[freq]
+	if !ok {
+		detection = &TrackedDetection{}
+		trackedDetections[freq] = detection
 	}
+	isNew = !ok || agingTime == 0 || now.Sub(detection.lastSeen) > agingTime
+	detection.lastSeen = now
+	detection.agingTime = agingTime
 
-	if sdrconnectSettings.FilterBandwidth == 0 {
-		result, err = getSdrconnectProperty("filter_bandwidth")
-		if err != nil {
-			return
+	// age out old entries (each one with the aging time of its scan,
+	// since the scans can have different aging times)
+	for f, d := range trackedDetections {
+		if d.agingTime > 0 && now.Sub(d.lastSeen) > d.agingTime {
+			delete(trackedDetections, f)
 		}
-		var filterBandwidth uint64
-		filterBandwidth, err = strconv.ParseUint(result, 10, 32)
-		if err != nil {
-			return
-		}
-		sdrconnectSettings.FilterBandwidth = uint32(filterBandwidth)
 	}
+	return
+}
 
-	if scan.LOSpans == nil {
-		scan.LOSpans = getLOSpans(scan)
+// isDetectionRateLimited returns true if a detection at this frequency
+// was already logged within the rate limit window; otherwise the
+// detection is counted as logged now
+func isDetectionRateLimited(freq uint64, rateLimit time.Duration) bool {
+	if rateLimit == 0 {
+		return false
+	}
+	now := time.Now()
+	if lastLogged, ok := lastLoggedDetections[freq]; ok && now.Sub(lastLogged) < rateLimit {
+		return true
 	}
+	lastLoggedDetections[freq] = now
+	return false
+}
 
+// trackDetectionRDSPI returns true if the RDS PI received at this frequency
+// is different from the one previously seen there (i.e. a different station)
+func trackDetectionRDSPI(freq uint64) (changed bool) {
+	detection, ok := trackedDetections[freq]
+	if !ok || len(receiveStats.rdsPI) == 0 {
+		return
+	}
+	rdsPI := receiveStats.rdsPI[0]
+	changed = detection.rdsPI != 0 && detection.rdsPI != rdsPI
+	detection.rdsPI = rdsPI
 	return
 }
 
-func runScan(scan *Scan) (err error) {
-	for freqAndLOFreq := range getScanFrequenciesAndLOFrequencies(scan) {
-		loFreq := freqAndLOFreq.loFrequency
-		if loFreq != 0 && loFreq != sdrconnectSettings.DeviceCenterFrequency {
-			err = setCenterFrequency(loFreq)
-			if err != nil {
-				return
-			}
-		}
+// calibration cache
+func getCalibrationCacheKey(scan *Scan) string {
+	device := scan.DeviceSerial
+	if device == "" {
+		device = scan.DeviceName
+	}
+	return fmt.Sprintf("device=%s profile=%s", device, scan.Profile)
+}
 
-		// clear receive stats
-		receiveStats.countMessages = 0
-		receiveStats.signalPower = receiveStats.signalPower[:0]
-		receiveStats.signalSNR = receiveStats.signalSNR[:0]
-		receiveStats.rdsPI = receiveStats.rdsPI[:0]
-		receiveStats.rdsPS = receiveStats.rdsPS[:0]
+// loadCalibrationCache loads the calibration cache file (if it exists);
+// the learned waits for the device and profile of the first scan are
+// applied right away, while the thresholds are applied when each scan
+// would be calibrated
+func loadCalibrationCache(scans []Scan) (err error) {
+	var data []byte
+	data, err = os.ReadFile(calibrationCacheFile)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	var cache CalibrationCache
+	err = json.Unmarshal(data, &cache)
+	if err != nil {
+		return
+	}
+	if cache.SchemaVersion != calibrationCacheSchemaVersion {
+		log.Printf("calibration cache schema version %d - ignoring it", cache.SchemaVersion)
+		return
+	}
+	if cache.Entries != nil {
+		calibrationCache.Entries = cache.Entries
+	}
+	if !adaptiveWaits || len(scans) == 0 {
+		return
+	}
+	entry, ok := calibrationCache.Entries[getCalibrationCacheKey(&scans[0])]
+	if !ok {
+		return
+	}
+	for _, latencyTracker := range []*LatencyTracker{&setPropertyLatency, &setCenterFrequencyLatency} {
+		if wait, ok := entry.Waits[latencyTracker.name]; ok {
+			*latencyTracker.wait = wait
+			// already learned
+			latencyTracker.count = adaptiveWaitSamples
+			log.Printf("adaptive waits: %s - wait: %v (from calibration cache)", latencyTracker.name, wait)
+		}
+	}
+	return
+}
 
-		freq := freqAndLOFreq.frequency
-		err = setVFOFrequencyAndGetSignalStats(freq, scan.DetectTime)
-		if err != nil {
-			return
+func saveCalibrationCache(scans []Scan) (err error) {
+	getEntry := func(key string) *CalibrationCacheEntry {
+		entry, ok := calibrationCache.Entries[key]
+		if !ok {
+			entry = &CalibrationCacheEntry{}
+			calibrationCache.Entries[key] = entry
 		}
-		if detectSignal(scan) {
-			showStats("detect")
-			err = receiveMessages(&sdrconnectSettings, nil, scan.ListenTime)
-			if err != nil {
-				return
-			}
-			if len(receiveStats.rdsPI) > 0 && scan.ListenExtraTimeRDS > 0 {
-				err = receiveMessages(&sdrconnectSettings, nil, scan.ListenExtraTimeRDS)
-				if err != nil {
-					return
+		return entry
+	}
+	if adaptiveWaits && len(scans) > 0 {
+		entry := getEntry(getCalibrationCacheKey(&scans[0]))
+		for _, latencyTracker := range []*LatencyTracker{&setPropertyLatency, &setCenterFrequencyLatency} {
+			if latencyTracker.count >= adaptiveWaitSamples {
+				if entry.Waits == nil {
+					entry.Waits = make(map[string]time.Duration)
 				}
+				entry.Waits[latencyTracker.name] = *latencyTracker.wait
 			}
-			showStats("listen")
 		}
 	}
+	for idx := range scans {
+		scan := &scans[idx]
+		if !scan.Calibrated {
+			continue
+		}
+		entry := getEntry(getCalibrationCacheKey(scan))
+		if entry.Thresholds == nil {
+			entry.Thresholds = make(map[string]CalibratedThresholds)
+		}
+		entry.Thresholds[scan.Name] = CalibratedThresholds{
+			DetectPowerThreshold: scan.DetectPowerThreshold,
+			DetectSNRThreshold:   scan.DetectSNRThreshold,
+		}
+	}
+	calibrationCache.SchemaVersion = calibrationCacheSchemaVersion
+	var data []byte
+	data, err = json.MarshalIndent(calibrationCache, "", "  ")
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(calibrationCacheFile, data, 0644)
 	return
 }
 
-// auxiliary functions
-
-func isTimeoutError(err error) bool {
-	var netErr net.Error
-	return errors.As(err, &netErr) && netErr.Timeout()
+// useCachedThresholds applies the calibrated thresholds for the scan from
+// the calibration cache, if any
+func useCachedThresholds(scan *Scan) bool {
+	entry, ok := calibrationCache.Entries[getCalibrationCacheKey(scan)]
+	if !ok {
+		return false
+	}
+	thresholds, ok := entry.Thresholds[scan.Name]
+	if !ok {
+		return false
+	}
+	scan.DetectPowerThreshold = thresholds.DetectPowerThreshold
+	scan.DetectSNRThreshold = thresholds.DetectSNRThreshold
+	log.Printf("scan %s: detect power threshold=%.1fdB detect snr threshold=%.1fdB (from calibration cache)", scan.Name, scan.DetectPowerThreshold, scan.DetectSNRThreshold)
+	return true
 }
 
-func restoreSdrconnectSettings(original SDRconnectSettings) {
-	setCenterFrequency(original.DeviceCenterFrequency)
-	setSdrconnectProperty("device_vfo_frequency", strconv.FormatUint(original.DeviceVFOFrequency, 10))
-	setSdrconnectProperty("demodulator", original.Demodulator.String())
-	setSdrconnectProperty("device_sample_rate", strconv.FormatFloat(original.SampleRate, 'f', -1, 64))
-}
+// scan plan
+func writeScanPlan(scans []Scan, planFile string, sampleRate float64, filterBandwidth uint32) (err error) {
+	var plans []ScanPlan
+	for idx := range scans {
+		scan := &scans[idx]
+		sdrconnectSettings.SampleRate = sampleRate
+		if scan.SampleRate != 0 {
+			sdrconnectSettings.SampleRate = scan.SampleRate
+		} else if len(scan.SampleRateOptions) > 0 {
+			sdrconnectSettings.SampleRate = scan.SampleRateOptions[0]
+		}
+		sdrconnectSettings.FilterBandwidth = filterBandwidth
+		err = computeLOSpans(scan)
+		if err != nil {
+			return
+		}
 
+		plan := ScanPlan{
+			SchemaVersion:        scanPlanSchemaVersion,
+			Start:                scan.Start,
+			Stop:                 scan.Stop,
+			Step:                 scan.Step,
+			List:                 scan.List,
+			DeviceName:           scan.DeviceName,
+			DeviceSerial:         scan.DeviceSerial,
+			Profile:              scan.Profile,
+			DetectPowerThreshold: scan.DetectPowerThreshold,
+			DetectSNRThreshold:   scan.DetectSNRThreshold,
+			DetectTimeMs:         scan.DetectTime.Milliseconds(),
+			ListenTimeMs:         scan.ListenTime.Milliseconds(),
+			SampleRate:           sdrconnectSettings.SampleRate,
+			FilterBandwidth:      sdrconnectSettings.FilterBandwidth,
+			IFBandwidth:          getIFBandwidth(scan, sdrconnectSettings.SampleRate),
+			LOOffset:             scan.LOOffset,
+		}
+		if scan.Demodulator != DemodulatorUnknown {
+			plan.Demodulator = scan.Demodulator.String()
+		}
+		for _, loSpan := range scan.LOSpans {
+			plan.LOSpans = append(plan.LOSpans, ScanPlanLOSpan{
+				From:            loSpan.from,
+				To:              loSpan.to,
+				CenterFrequency: loSpan.frequency,
+			})
+		}
+		var centerFrequency uint64
+		done := make(chan struct{})
+		for freqAndLOFreq := range getScanFrequenciesAndLOFrequencies(scan, done) {
+			if freqAndLOFreq.loFrequency != 0 {
+				centerFrequency = freqAndLOFreq.loFrequency
+			}
+			plan.Frequencies = append(plan.Frequencies, ScanPlanFrequency{
+				Frequency:       freqAndLOFreq.frequency,
+				CenterFrequency: centerFrequency,
+			})
+		}
+		close(done)
+		plans = append(plans, plan)
+	}
 
-// config file
-func getStringConfigSetting(setting string, section *ini.Section) (value string, ok bool, err error) {
-	if section.HasKey(setting) {
-		value = section.Key(setting).String()
-		ok = true
-	} else if defaultSection.HasKey(setting) {
-		value = defaultSection.Key(setting).String()
-		ok = true
+	var data []byte
+	data, err = json.MarshalIndent(plans, "", "  ")
+	if err != nil {
+		return
 	}
+	err = os.WriteFile(planFile, data, 0644)
 	return
 }
 
-func getUint32ConfigSetting(setting string, section *ini.Section) (value uint32, ok bool, err error) {
-	var valueUint uint
-	if section.HasKey(setting) {
-		valueUint, err = section.Key(setting).Uint()
-		ok = true
-	} else if defaultSection.HasKey(setting) {
-		valueUint, err = defaultSection.Key(setting).Uint()
-		ok = true
+// cycle detections
+func recordDetection(scan *Scan, freq uint64) {
+	detection := Detection{
+		scan:        scan,
+		time:        time.Now(),
+		frequency:   freq,
+		labels:      getStationLabels(freq),
+		signalPower: getSignalMax(receiveStats.signalPower),
+		signalSNR:   getSignalMax(receiveStats.signalSNR),
+		rdsPS:       strings.Join(receiveStats.rdsPS, "|"),
 	}
-	if err == nil {
-		value = uint32(valueUint)
+	if len(receiveStats.rdsPI) > 0 {
+		detection.rdsPI = receiveStats.rdsPI[0]
+	}
+	// composite signal quality score
+	if len(receiveStats.signalPower) > 0 {
+		detection.score += scorePowerWeight * detection.signalPower
+	}
+	if len(receiveStats.signalSNR) > 0 {
+		detection.score += scoreSNRWeight * detection.signalSNR
+	}
+	if detection.rdsPI != 0 {
+		detection.score += scoreRDSWeight
+	}
+	cycleDetections = append(cycleDetections, detection)
+	if reportFile != "" {
+		addReportEntry(detection)
 	}
-	return
 }
 
-func getUint64ConfigSetting(setting string, section *ini.Section) (value uint64, ok bool, err error) {
-	if section.HasKey(setting) {
-		value, err = section.Key(setting).Uint64()
-		ok = true
-	} else if defaultSection.HasKey(setting) {
-		value, err = defaultSection.Key(setting).Uint64()
-		ok = true
+func showTopStations() {
+	// nothing to rank on a quiet band
+	if len(cycleDetections) == 0 {
+		return
+	}
+	ranking := slices.Clone(cycleDetections)
+	slices.SortStableFunc(ranking, func(a, b Detection) int {
+		return cmp.Compare(b.score, a.score)
+	})
+	if len(ranking) > topStations {
+		ranking = ranking[:topStations]
+	}
+	log.Printf("top %d stations this cycle:", topStations)
+	for rank, detection := range ranking {
+		fields := []string{
+			fmt.Sprintf("#%d", rank+1),
+			"f=" + formatFrequency(detection.scan, detection.frequency),
+		}
+		for _, label := range detection.labels {
+			fields = append(fields, fmt.Sprintf("l=%s", label))
+		}
+		fields = append(fields, fmt.Sprintf("score=%.1f", detection.score))
+		log.Println(strings.Join(fields, " "))
 	}
-	return
 }
 
-func getFloat64ConfigSetting(setting string, section *ini.Section) (value float64, ok bool, err error) {
-	if section.HasKey(setting) {
-		value, err = section.Key(setting).Float64()
-		ok = true
-	} else if defaultSection.HasKey(setting) {
-		value, err = defaultSection.Key(setting).Float64()
-		ok = true
+// adaptive listen time
+// busy scans (many detections in the previous cycle) get a shorter listen
+// time to keep up, quiet ones a longer one, within the configured bounds
+var adaptiveListenBusyDensity = 0.1
+var adaptiveListenQuietDensity = 0.02
+var adaptiveListenFactor = 1.25
+
+func adaptListenTime(scan *Scan) {
+	if scan.ListenTimeMax == 0 {
+		return
+	}
+	count := getScanFrequencyCount(scan)
+	if count == 0 {
+		return
+	}
+	var detections int
+	for _, detection := range cycleDetections {
+		if detection.scan == scan {
+			detections++
+		}
+	}
+	density := float64(detections) / float64(count)
+	listenTime := scan.ListenTime
+	if density >= adaptiveListenBusyDensity {
+		listenTime = time.Duration(float64(listenTime) / adaptiveListenFactor)
+	} else if density <= adaptiveListenQuietDensity {
+		listenTime = time.Duration(float64(listenTime) * adaptiveListenFactor)
+	}
+	listenTime = min(max(listenTime, scan.ListenTimeMin), scan.ListenTimeMax).Round(time.Millisecond)
+	if listenTime != scan.ListenTime {
+		log.Printf("scan %s: %d detections on %d frequencies - listen time %v -> %v", scan.Name, detections, count, scan.ListenTime, listenTime)
+		scan.ListenTime = listenTime
 	}
-	return
 }
 
-// SDRconnect via websocket interface
-func getSdrconnectProperty(property string) (value string, err error) {
-	request := Message{
-		EventType: "get_property",
-		Property:  property,
+// showMergedDetections shows the detections of this scan pass, with runs
+// of detections no more than MergeDetectionsWithin apart collapsed into
+// a single entry with the frequency range and the peak stats
+func showMergedDetections(scan *Scan) {
+	var detections []Detection
+	for _, detection := range cycleDetections {
+		if detection.scan == scan {
+			detections = append(detections, detection)
+		}
 	}
-	err = websocket.JSON.Send(ws, request)
-	if err != nil {
+	if len(detections) == 0 {
 		return
 	}
-	var message Message
-	ws.SetReadDeadline(time.Now().Add(waitGetProperty))
-	defer ws.SetReadDeadline(time.Time{})
-	for {
-		err = websocket.JSON.Receive(ws, &message)
-		if err != nil {
-			err = fmt.Errorf("getSdrconnectProperty(%s): %w", property, err)
-			return
+	slices.SortFunc(detections, func(a, b Detection) int {
+		return cmp.Compare(a.frequency, b.frequency)
+	})
+	show := func(run []Detection) {
+		from := run[0].frequency
+		to := run[len(run)-1].frequency
+		var fields []string
+		if from == to {
+			fields = append(fields, "merged", "f="+formatFrequency(scan, from))
+		} else {
+			fields = append(fields, "merged", "f="+formatFrequency(scan, from)+"-"+formatFrequency(scan, to))
 		}
-		if message.EventType == "get_property_response" {
-			if message.Property == property {
-				value = message.Value
-				return
-			}
+		signalPower := run[0].signalPower
+		signalSNR := run[0].signalSNR
+		for _, detection := range run[1:] {
+			signalPower = max(signalPower, detection.signalPower)
+			signalSNR = max(signalSNR, detection.signalSNR)
+		}
+		fields = append(fields, fmt.Sprintf("n=%d", len(run)))
+		fields = append(fields, fmt.Sprintf("pwr=%.1fdB", signalPower))
+		fields = append(fields, fmt.Sprintf("snr=%.1fdB", signalSNR))
+		showLine(scan, fields)
+	}
+	runStart := 0
+	for idx := 1; idx < len(detections); idx++ {
+		if detections[idx].frequency-detections[idx-1].frequency > scan.MergeDetectionsWithin {
+			show(detections[runStart:idx])
+			runStart = idx
 		}
 	}
+	show(detections[runStart:])
 }
 
-func setSdrconnectProperty(property string, value string) (actualValue string, changed bool, err error) {
-	request := Message{
-		EventType: "set_property",
-		Property:  property,
-		Value:     value,
+// report
+// the report has one entry per scan and frequency with the peak stats
+// over the whole run
+func addReportEntry(detection Detection) {
+	scanEntries, ok := reportEntries[detection.scan.Name]
+	if !ok {
+		scanEntries = make(map[uint64]*ReportEntry)
+		reportEntries[detection.scan.Name] = scanEntries
+		reportScanNames = append(reportScanNames, detection.scan.Name)
+	}
+	entry, ok := scanEntries[detection.frequency]
+	if !ok {
+		entry = &ReportEntry{
+			frequency:   detection.frequency,
+			firstSeen:   detection.time,
+			signalPower: detection.signalPower,
+			signalSNR:   detection.signalSNR,
+		}
+		scanEntries[detection.frequency] = entry
+	}
+	entry.count++
+	entry.lastSeen = detection.time
+	entry.signalPower = max(entry.signalPower, detection.signalPower)
+	entry.signalSNR = max(entry.signalSNR, detection.signalSNR)
+	if len(detection.labels) > 0 {
+		entry.labels = detection.labels
 	}
-	err = websocket.JSON.Send(ws, request)
+	if detection.rdsPI != 0 {
+		entry.rdsPI = detection.rdsPI
+	}
+	if detection.rdsPS != "" {
+		entry.rdsPS = detection.rdsPS
+	}
+}
+
+func writeReport() (err error) {
+	var file *os.File
+	file, err = os.Create(reportFile)
 	if err != nil {
 		return
 	}
-	var message Message
-	ws.SetReadDeadline(time.Now().Add(waitSetProperty))
-	defer ws.SetReadDeadline(time.Time{})
-	for {
-		err = websocket.JSON.Receive(ws, &message)
-		if err != nil {
-			// ignore timeouts because the property might already
-			// have been at the correct value
-			if errors.Is(err, os.ErrDeadlineExceeded) {
-				actualValue = value
-				err = nil
-			} else {
-				err = fmt.Errorf("setSdrconnectProperty(%s): %w", property, err)
+	defer file.Close()
+
+	const timeFormat = "2006-01-02 15:04:05"
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "sdrconnect-scanner report\n")
+	fmt.Fprintf(w, "from %s to %s\n", reportStart.Format(timeFormat), time.Now().Format(timeFormat))
+	if len(reportScanNames) == 0 {
+		fmt.Fprintf(w, "\nno detections\n")
+	}
+	for _, scanName := range reportScanNames {
+		scanEntries := reportEntries[scanName]
+		fmt.Fprintf(w, "\nscan %s: %d frequencies\n", scanName, len(scanEntries))
+		for _, freq := range slices.Sorted(maps.Keys(scanEntries)) {
+			entry := scanEntries[freq]
+			fields := []string{
+				fmt.Sprintf("%12d", entry.frequency),
+				fmt.Sprintf("detections=%d", entry.count),
+				fmt.Sprintf("first=%s", entry.firstSeen.Format(timeFormat)),
+				fmt.Sprintf("last=%s", entry.lastSeen.Format(timeFormat)),
+				fmt.Sprintf("peak_power=%.1f", entry.signalPower),
+				fmt.Sprintf("peak_snr=%.1f", entry.signalSNR),
 			}
-			return
-		}
-		if debug {
-			log.Println("message:", message.EventType, message.Property, message.Value)
-		}
-		if message.EventType == "property_changed" {
-			if message.Property == property {
-				actualValue = message.Value
-				changed = true
-				return
+			if entry.rdsPI != 0 {
+				fields = append(fields, fmt.Sprintf("pi=%04X", entry.rdsPI))
+			}
+			if entry.rdsPS != "" {
+				fields = append(fields, fmt.Sprintf("ps=%s", entry.rdsPS))
 			}
+			for _, label := range entry.labels {
+				fields = append(fields, fmt.Sprintf("l=%s", label))
+			}
+			fmt.Fprintln(w, strings.Join(fields, "  "))
 		}
 	}
+	err = w.Flush()
+	return
 }
 
-func selectSdrconnectDeviceByName(device_name string) (err error) {
-	request := Message{
-		EventType: "selected_device_name",
-		Value:     device_name,
+// database
+func openDatabase(dbFile string) (err error) {
+	db, err = sql.Open("sqlite", dbFile)
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS detections (
+		timestamp TEXT NOT NULL,
+		scan TEXT,
+		frequency INTEGER NOT NULL,
+		power REAL,
+		snr REAL,
+		pi TEXT,
+		ps TEXT,
+		label TEXT,
+		mode TEXT
+	)`)
+	return
+}
+
+// detections are inserted in a transaction that is committed every
+// dbCommitRows rows (or dbCommitInterval), to avoid an fsync for each row
+func insertDetection(scan *Scan, freq uint64) (err error) {
+	if dbTx == nil {
+		dbTx, err = db.Begin()
+		if err != nil {
+			return
+		}
+		dbTxStart = time.Now()
+		dbInsert, err = dbTx.Prepare("INSERT INTO detections (timestamp, scan, frequency, power, snr, pi, ps, label, mode) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		if err != nil {
+			return
+		}
+	}
+	var signalPower, signalSNR, rdsPI any
+	if len(receiveStats.signalPower) > 0 {
+		signalPower = getSignalMax(receiveStats.signalPower)
+	}
+	if len(receiveStats.signalSNR) > 0 {
+		signalSNR = getSignalMax(receiveStats.signalSNR)
+	}
+	if len(receiveStats.rdsPI) > 0 {
+		rdsPI = fmt.Sprintf("%04X", receiveStats.rdsPI[0])
 	}
-	err = websocket.JSON.Send(ws, request)
+	_, err = dbInsert.Exec(
+		time.Now().Format(time.RFC3339Nano),
+		scan.Name,
+		int64(freq),
+		signalPower,
+		signalSNR,
+		rdsPI,
+		strings.Join(receiveStats.rdsPS, "|"),
+		strings.Join(getStationLabels(freq), "|"),
+		sdrconnectSettings.Demodulator.String(),
+	)
 	if err != nil {
 		return
 	}
-	err = receiveMessages(&sdrconnectSettings, nil, waitSelectDevice)
+	dbTxRows++
+	if dbTxRows >= dbCommitRows || time.Since(dbTxStart) >= dbCommitInterval {
+		err = commitDatabase()
+	}
 	return
 }
 
-func selectSdrconnectDeviceBySerial(device_serial string) (err error) {
-	request := Message{
-		EventType: "selected_device_serial",
-		Value:     device_serial,
-	}
-	err = websocket.JSON.Send(ws, request)
-	if err != nil {
+func commitDatabase() (err error) {
+	if dbTx == nil {
 		return
 	}
-	err = receiveMessages(&sdrconnectSettings, nil, waitSelectDevice)
+	dbInsert.Close()
+	err = dbTx.Commit()
+	dbTx = nil
+	dbInsert = nil
+	dbTxRows = 0
 	return
 }
 
-func applySdrconnectProfile(profile string) (err error) {
-	request := Message{
-		EventType: "apply_device_profile",
-		Value:     profile,
+func closeDatabase() {
+	if err := commitDatabase(); err != nil {
+		priorityLog.Println("error writing detections to database:", err)
+	}
+	db.Close()
+}
+
+// MQTT
+// the client reconnects in the background, so the scan is never blocked
+// by the broker
+func connectMQTT(broker string) {
+	options := mqtt.NewClientOptions()
+	options.AddBroker(broker)
+	options.SetClientID(fmt.Sprintf("sdrconnect-scanner-%d", os.Getpid()))
+	options.SetAutoReconnect(true)
+	options.SetConnectRetry(true)
+	options.SetConnectRetryInterval(10 * time.Second)
+	options.SetOnConnectHandler(func(mqtt.Client) {
+		log.Println("connected to MQTT broker", broker)
+	})
+	options.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		priorityLog.Println("MQTT connection lost:", err)
+	})
+	mqttClient = mqtt.NewClient(options)
+	mqttClient.Connect()
+}
+
+func publishDetection(scan *Scan, freq uint64) {
+	event := DetectionEvent{
+		SchemaVersion: detectionEventSchemaVersion,
+		Timestamp:     time.Now().Format(time.RFC3339Nano),
+		Scan:          scan.Name,
+		Frequency:     freq,
+		RDSPS:         strings.Join(receiveStats.rdsPS, "|"),
+		Labels:        getStationLabels(freq),
+		Demodulator:   sdrconnectSettings.Demodulator.String(),
+	}
+	if len(receiveStats.signalPower) > 0 {
+		signalPower := getSignalMax(receiveStats.signalPower)
+		event.Power = &signalPower
 	}
-	err = websocket.JSON.Send(ws, request)
+	if len(receiveStats.signalSNR) > 0 {
+		signalSNR := getSignalMax(receiveStats.signalSNR)
+		event.SNR = &signalSNR
+	}
+	if len(receiveStats.rdsPI) > 0 {
+		event.RDSPI = fmt.Sprintf("%04X", receiveStats.rdsPI[0])
+	}
+	payload, err := json.Marshal(event)
 	if err != nil {
+		priorityLog.Println("error encoding MQTT detection:", err)
 		return
 	}
-	// fv
-	//err = receiveMessages(&sdrconnectSettings, regexp.MustCompile("^.*VCVC$"), waitApplyProfile)
-	err = receiveMessages(&sdrconnectSettings, nil, waitApplyProfile)
-	return
+	topic := strings.NewReplacer("{scan}", scan.Name, "{frequency}", strconv.FormatUint(freq, 10)).Replace(mqttTopic)
+	token := mqttClient.Publish(topic, 0, false, payload)
+	go func() {
+		token.Wait()
+		if token.Error() != nil && debug {
+			priorityLog.Println("error publishing MQTT detection:", token.Error())
+		}
+	}()
 }
 
-func receiveMessages(settings *SDRconnectSettings, sequencePattern *regexp.Regexp, timeout time.Duration) (err error) {
-	var message Message
-	var sequence string
-	var paused bool
-	ws.SetReadDeadline(time.Now().Add(timeout))
-	defer ws.SetReadDeadline(time.Time{})
-	for {
-		err = websocket.JSON.Receive(ws, &message)
-		if err != nil {
-			if errors.Is(err, os.ErrDeadlineExceeded) && sequencePattern == nil && receiveStats.countMessages > 0 {
-				err = nil
-			}
+// channel occupancy
+func updateOccupancy(scan *Scan, freq uint64, signalDetected bool) {
+	if scan.Occupancy == nil {
+		scan.Occupancy = make(map[uint64]*OccupancyCount)
+	}
+	occupancy, ok := scan.Occupancy[freq]
+	if !ok {
+		occupancy = &OccupancyCount{}
+		scan.Occupancy[freq] = occupancy
+	}
+	occupancy.passes++
+	if signalDetected {
+		occupancy.detections++
+	}
+}
+
+// dropouts
+// a frequency that was active in the previous pass and is now silent
+// is reported as an absence (or as 'gone' with the detection deltas)
+func updateActiveState(scan *Scan, freq uint64, active bool) {
+	if scan.Active == nil {
+		scan.Active = make(map[uint64]bool)
+	}
+	previous := scan.Active[freq]
+	scan.Active[freq] = active
+	if scan.DetectionDeltas {
+		// each frequency scanned in this pass is classified relative
+		// to the previous pass, and shown at the end of the pass
+		var what string
+		switch {
+		case active && !previous:
+			what = "new"
+		case active && previous:
+			what = "still"
+		case !active && previous:
+			what = "gone"
+		default:
 			return
 		}
-		receiveStats.countMessages++
-		if debug {
-			log.Println("message:", message.EventType, message.Property, message.Value)
+		if scan.Deltas == nil {
+			scan.Deltas = make(map[uint64]string)
 		}
-
-		// handle user commands
-		if userCommandTerminate {
-			userCommandTerminate = false
-			err = ErrUserCommandTerminate
-			return
-		} else if userCommandNextScan {
-			userCommandNextScan = false
-			err = ErrUserCommandNextScan
-			return
-		} else if userCommandTogglePause {
-			userCommandTogglePause = false
-			if !paused {
-				ws.SetReadDeadline(time.Time{})
-			} else {
-				ws.SetReadDeadline(time.Now())
-			}
-			paused = !paused
+		scan.Deltas[freq] = what
+		return
+	}
+	if previous && !active {
+		fields := []string{"absence", "f=" + formatFrequency(scan, freq)}
+		for _, label := range getStationLabels(freq) {
+			fields = append(fields, fmt.Sprintf("l=%s", label))
 		}
+		showLine(scan, fields)
+	}
+}
 
-		if message.EventType == "property_changed" {
-			switch message.Property {
-			case "device_sample_rate":
-				settings.SampleRate, _ = strconv.ParseFloat(message.Value, 64)
-				sequence += "S"
-			case "device_vfo_frequency":
-				settings.DeviceVFOFrequency, _ = strconv.ParseUint(message.Value, 10, 64)
-				sequence += "V"
-			case "device_center_frequency":
-				settings.DeviceCenterFrequency, _ = strconv.ParseUint(message.Value, 10, 64)
-				sequence += "C"
-			case "filter_bandwidth":
-				filterBandwidth, _ := strconv.ParseUint(message.Value, 10, 32)
-				settings.FilterBandwidth = uint32(filterBandwidth)
-				sequence += "F"
-			case "signal_power":
-				if len(receiveStats.signalPower) < cap(receiveStats.signalPower) {
-					signalPower, _ := strconv.ParseFloat(message.Value, 64)
-					receiveStats.signalPower = append(receiveStats.signalPower, signalPower)
-				}
-			case "signal_snr":
-				if len(receiveStats.signalSNR) < cap(receiveStats.signalSNR) {
-					signalSNR, _ := strconv.ParseFloat(message.Value, 64)
-					receiveStats.signalSNR = append(receiveStats.signalSNR, signalSNR)
-				}
-			case "rds_pi":
-				if len(receiveStats.rdsPI) < cap(receiveStats.rdsPI) {
-					rdsPI, _ := strconv.ParseUint(message.Value, 10, 16)
-					if rdsPI != 0 {
-						receiveStats.rdsPI = append(receiveStats.rdsPI, uint16(rdsPI))
-					}
-				}
-			case "rds_ps":
-				if len(receiveStats.rdsPS) < cap(receiveStats.rdsPS) {
-					rdsPS := strings.TrimSpace(message.Value)
-					if rdsPS != "" {
-						receiveStats.rdsPS = append(receiveStats.rdsPS, rdsPS)
-					}
-				}
-			// SDRconnect properties
-			case "demodulator":
-				settings.Demodulator, _ = ParseDemodulatorMode(message.Value)
-			case "lna_state":
-				lnaState, _ := strconv.ParseUint(message.Value, 0, 32)
-				settings.LNAState = uint32(lnaState)
-			case "squelch_enable":
-				settings.SquelchEnable, _ = strconv.ParseBool(message.Value)
-			case "squelch_threshold":
-				settings.SquelchThreshold, _ = strconv.ParseFloat(message.Value, 64)
-			case "agc_enable":
-				settings.AGCEnable, _ = strconv.ParseBool(message.Value)
-			case "agc_threshold":
-				settings.AGCThreshold, _ = strconv.ParseFloat(message.Value, 64)
-			}
-			if sequencePattern != nil && sequencePattern.MatchString(sequence) {
-				break
-			}
+// detection deltas
+// showDetectionDeltas shows the frequencies that are 'new' (not active in
+// the previous pass), 'still' active, or 'gone' (active in the previous
+// pass, silent now); the frequencies not scanned in this pass (for instance
+// because of 'stop on first') keep their previous state
+func showDetectionDeltas(scan *Scan) {
+	for _, freq := range slices.Sorted(maps.Keys(scan.Deltas)) {
+		fields := []string{scan.Deltas[freq], "f=" + formatFrequency(scan, freq)}
+		if label, ok := getFrequencyLabel(freq); ok {
+			fields = append(fields, fmt.Sprintf("l=%s", label))
 		}
+		showLine(scan, fields)
 	}
-	return
+	clear(scan.Deltas)
 }
 
-func setCenterFrequency(loFreq uint64) (err error) {
-	request := Message{
-		EventType: "set_property",
-		Property:  "device_center_frequency",
-		Value:     strconv.FormatUint(loFreq, 10),
-	}
-	err = websocket.JSON.Send(ws, request)
-	if err != nil {
-		return
-	}
-	err = receiveMessages(&sdrconnectSettings, regexp.MustCompile("^.*CV$"), waitSetCenterFrequency)
+func writeOccupancyFile(scan *Scan) (err error) {
+	var file *os.File
+	file, err = os.Create(scan.OccupancyFile)
 	if err != nil {
 		return
 	}
-	if sdrconnectSettings.DeviceCenterFrequency != loFreq {
-		err = fmt.Errorf("error setting center frequency - requested: %d - actual: %d", loFreq, sdrconnectSettings.DeviceCenterFrequency)
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"frequency", "detections", "total_passes", "occupancy_pct"})
+	done := make(chan struct{})
+	defer close(done)
+	for freqAndIdx := range getScanFrequenciesAndIndexes(scan, done) {
+		occupancy, ok := scan.Occupancy[freqAndIdx.frequency]
+		if !ok || occupancy.passes == 0 {
+			continue
+		}
+		writer.Write([]string{
+			strconv.FormatUint(freqAndIdx.frequency, 10),
+			strconv.Itoa(occupancy.detections),
+			strconv.Itoa(occupancy.passes),
+			strconv.FormatFloat(100*float64(occupancy.detections)/float64(occupancy.passes), 'f', 1, 64),
+		})
 	}
+	writer.Flush()
+	err = writer.Error()
 	return
 }
 
-func setVFOFrequencyAndGetSignalStats(freq uint64, detectTime time.Duration) (err error) {
-	request := Message{
-		EventType: "set_property",
-		Property:  "device_vfo_frequency",
-		Value:     strconv.FormatUint(freq, 10),
+// getStatsWindow returns the last statsWindow samples (all of them if
+// statsWindow is 0), so the reported stats reflect the signal once stable
+func getStatsWindow(samples []float64, statsWindow int) []float64 {
+	if statsWindow > 0 && len(samples) > statsWindow {
+		return samples[len(samples)-statsWindow:]
 	}
-	err = websocket.JSON.Send(ws, request)
-	if err != nil {
-		return
+	return samples
+}
+
+// getStationLabels returns the labels for the RDS PI (if any) and
+// for the frequency
+func getStationLabels(freq uint64) (stationLabels []string) {
+	stationLabels = getRDSPILabels()
+	if label, ok := getFrequencyLabel(freq); ok && !slices.Contains(stationLabels, label) {
+		stationLabels = append(stationLabels, label)
 	}
-	err = receiveMessages(&sdrconnectSettings, nil, detectTime)
-	if err != nil {
-		return
+	return
+}
+
+// getRDSPILabels returns the labels of all the distinct RDS PIs received,
+// the most frequent first, since in crowded conditions the first decoded
+// PI might not be the one of the dominant station
+func getRDSPILabels() (rdsPILabels []string) {
+	rdsPICount := make(map[uint16]int)
+	var rdsPIs []uint16
+	for _, rdsPI := range receiveStats.rdsPI {
+		if rdsPICount[rdsPI] == 0 {
+			rdsPIs = append(rdsPIs, rdsPI)
+		}
+		rdsPICount[rdsPI]++
 	}
-	if sdrconnectSettings.DeviceVFOFrequency != freq {
-		err = fmt.Errorf("error setting VFO frequency - requested: %d - actual: %d", freq, sdrconnectSettings.DeviceVFOFrequency)
+	slices.SortStableFunc(rdsPIs, func(a, b uint16) int {
+		return rdsPICount[b] - rdsPICount[a]
+	})
+	for _, rdsPI := range rdsPIs {
+		if label, ok := labels[uint64(rdsPI)]; ok && !slices.Contains(rdsPILabels, label) {
+			rdsPILabels = append(rdsPILabels, label)
+		}
 	}
 	return
 }
 
-// other useful functions
-func getIFBandwidth(sampleRate float64) uint32 {
-	bandwidthskHz := []uint32{200, 300, 600, 1536, 5000, 6000, 7000, 8000}
-
-	rate := uint32(sampleRate / 1000)
-	prevBandwidth := bandwidthskHz[0]
-	for _, bandwidth := range bandwidthskHz {
-		if rate < bandwidth {
-			return prevBandwidth * 1000
-		}
-		prevBandwidth = bandwidth
+// getFrequencyLabel returns the label of the frequency, or the label of
+// the nearest labeled frequency within the label tolerance
+func getFrequencyLabel(freq uint64) (label string, ok bool) {
+	if label, ok = labels[freq]; ok {
+		return
 	}
-	return prevBandwidth * 1000
+	if nearestFreq, nearest := getNearestLabelFrequency(freq); nearest {
+		// marked with '~' since the frequency is only close
+		return "~" + labels[nearestFreq], true
+	}
+	return
 }
 
-func getLOSpans(scan *Scan) (loSpans []LOSpan) {
-	maxDf := uint64(getIFBandwidth(sdrconnectSettings.SampleRate) -
-		sdrconnectSettings.FilterBandwidth -
-		uint32(max(scan.LOOffset, -scan.LOOffset)))
-	var fmin uint64 = math.MaxUint64
-	var fmax uint64 = 0
-	flo := (fmin + fmax) / 2
-	var idxFrom int
-	var idxTo int
-	for freqAndIdx := range getScanFrequenciesAndIndexes(scan) {
-		freq := freqAndIdx.frequency
-		idx := freqAndIdx.index
-		fmin = min(fmin, freq)
-		fmax = max(fmax, freq)
-		df := fmax - fmin
-		if df > maxDf {
-			loSpans = append(loSpans, LOSpan{
-				from:      idxFrom,
-				to:        idxTo,
-				frequency: uint64(int64(flo) + int64(scan.LOOffset)),
-			})
-			idxFrom = idx
-			fmin = freq
-			fmax = freq
+// getNearestLabelFrequency returns the labeled frequency closest to freq,
+// if it is within the label tolerance
+func getNearestLabelFrequency(freq uint64) (nearestFreq uint64, ok bool) {
+	if labelTolerance == 0 || len(labelFrequencies) == 0 {
+		return
+	}
+	idx, _ := slices.BinarySearch(labelFrequencies, freq)
+	var bestDf uint64 = math.MaxUint64
+	for _, i := range []int{idx - 1, idx} {
+		if i < 0 || i >= len(labelFrequencies) {
+			continue
+		}
+		df := max(labelFrequencies[i], freq) - min(labelFrequencies[i], freq)
+		if df < bestDf {
+			nearestFreq = labelFrequencies[i]
+			bestDf = df
 		}
-		flo = (fmin + fmax) / 2
-		idxTo = idx
 	}
-	loSpans = append(loSpans, LOSpan{
-		from:      idxFrom,
-		to:        idxTo,
-		frequency: uint64(int64(flo) + int64(scan.LOOffset)),
-	})
+	ok = bestDf <= labelTolerance
 	return
 }
 
-func detectSignal(scan *Scan) (signalDetected bool) {
-	var signalPowerMax float64
-	switch len(receiveStats.signalPower) {
-	case 0:
-		signalPowerMax = -1000
-		break
-	case 1:
-		signalPowerMax = receiveStats.signalPower[0]
-	default:
-		// ignore the first element since it might be tainted
-		// by the previous frequency
-		signalPowerMax = slices.Max(receiveStats.signalPower[1:])
+// formatFrequency formats a frequency (in Hz) in the display unit and
+// precision of the scan; the frequencies are always stored in Hz, so the
+// rounding only affects the display
+func formatFrequency(scan *Scan, freq uint64) string {
+	switch scan.DisplayUnit {
+	case "khz":
+		return strconv.FormatFloat(float64(freq)/1e3, 'f', scan.DisplayPrecision, 64) + "kHz"
+	case "mhz":
+		return strconv.FormatFloat(float64(freq)/1e6, 'f', scan.DisplayPrecision, 64) + "MHz"
 	}
-	var signalSNRMax float64
-	switch len(receiveStats.signalSNR) {
-	case 0:
-		signalSNRMax = -1000
-		break
-	case 1:
-		signalSNRMax = receiveStats.signalSNR[0]
-	default:
-		// ignore the first element since it might be tainted
-		// by the previous frequency
-		signalSNRMax = slices.Max(receiveStats.signalSNR[1:])
+	if scan.DisplayPrecision > 0 {
+		return strconv.FormatFloat(float64(freq), 'f', scan.DisplayPrecision, 64)
 	}
-
-	signalDetected = signalPowerMax >= scan.DetectPowerThreshold || signalSNRMax >= scan.DetectSNRThreshold
-	return
+	return strconv.FormatUint(freq, 10)
 }
 
-func showStats(what string) {
+func showStats(scan *Scan, what string) {
 	var fields []string
 	if what != "" {
 		fields = append(fields, what)
 	}
 	freq := sdrconnectSettings.DeviceVFOFrequency
-	fields = append(fields, fmt.Sprintf("f=%d", freq))
-	if len(receiveStats.rdsPI) > 0 {
-		rdsPI := uint64(receiveStats.rdsPI[0])
-		if label, ok := labels[rdsPI]; ok {
-			fields = append(fields, fmt.Sprintf("l=%s", label))
-		}
+	fields = append(fields, "f="+formatFrequency(scan, freq))
+	// the position in the IF helps telling images and spurs apart
+	if verbose {
+		loFreq := sdrconnectSettings.DeviceCenterFrequency
+		fields = append(fields, "lo="+formatFrequency(scan, loFreq), fmt.Sprintf("if=%+d", int64(freq)-int64(loFreq)))
 	}
-	if label, ok := labels[freq]; ok {
+	for _, label := range getStationLabels(freq) {
 		fields = append(fields, fmt.Sprintf("l=%s", label))
 	}
 	if len(receiveStats.signalPower) == 1 {
 		fields = append(fields, fmt.Sprintf("pwr=%.1fdB", receiveStats.signalPower[0]))
 	} else if len(receiveStats.signalPower) > 1 {
-		fields = append(fields, fmt.Sprintf("pwr=[%.1fdB,%.1fdB]", slices.Min(receiveStats.signalPower[1:]), slices.Max(receiveStats.signalPower[1:])))
+		signalPower := getStatsWindow(receiveStats.signalPower[1:], scan.StatsWindow)
+		fields = append(fields, fmt.Sprintf("pwr=[%.1fdB,%.1fdB]", slices.Min(signalPower), slices.Max(signalPower)))
 	}
 	if len(receiveStats.signalSNR) == 1 {
 		fields = append(fields, fmt.Sprintf("snr=%.1fdB", receiveStats.signalSNR[0]))
 	} else if len(receiveStats.signalSNR) > 1 {
-		fields = append(fields, fmt.Sprintf("snr=[%.1f.dB,%.1fdB]", slices.Min(receiveStats.signalSNR[1:]), slices.Max(receiveStats.signalSNR[1:])))
+		signalSNR := getStatsWindow(receiveStats.signalSNR[1:], scan.StatsWindow)
+		fields = append(fields, fmt.Sprintf("snr=[%.1f.dB,%.1fdB]", slices.Min(signalSNR), slices.Max(signalSNR)))
 	}
 	if len(receiveStats.rdsPI) > 0 {
 		rdsPIset := make(map[uint16]int)
@@ -1256,75 +5469,198 @@ func showStats(what string) {
 	if len(receiveStats.rdsPS) > 0 {
 		fields = append(fields, fmt.Sprintf("RDS/PS=%s", strings.Join(receiveStats.rdsPS, "|")))
 	}
-	log.Println(strings.Join(fields, " "))
+	if receiveStats.stereoPilot {
+		fields = append(fields, "stereo=yes")
+	}
+	if receiveStats.detectTrigger != "" {
+		fields = append(fields, fmt.Sprintf("trig=%s", receiveStats.detectTrigger))
+	}
+	if what == "listen" && scan.CWKeyingDetection && sdrconnectSettings.Demodulator == DemodulatorCW {
+		if keying, wpm := analyzeCWKeying(); keying && wpm > 0 {
+			fields = append(fields, fmt.Sprintf("cw=yes wpm~%d", wpm))
+		} else if keying {
+			fields = append(fields, "cw=yes")
+		} else {
+			fields = append(fields, "cw=no")
+		}
+	}
+	showLine(scan, fields)
+}
+
+// showLine writes a line to the scan output file and/or the log; the
+// first two fields are the event (detect, listen, etc) and the frequency
+func showLine(scan *Scan, fields []string) {
+	if scan.OutputWriter != nil {
+		scan.OutputWriter.Write([]string{
+			time.Now().Format(time.RFC3339Nano),
+			scan.Name,
+			fields[0],
+			strings.TrimPrefix(fields[1], "f="),
+			strings.Join(fields[2:], " "),
+		})
+		scan.OutputWriter.Flush()
+		if err := scan.OutputWriter.Error(); err != nil {
+			priorityLog.Println("error writing output file:", err)
+		}
+	}
+	if scan.OutputWriter == nil || !scan.OutputOnly {
+		priorityLog.Println(strings.Join(fields, " "))
+	}
+}
+
+func (tw *ThrottledWriter) Write(p []byte) (n int, err error) {
+	return tw.write(p, false)
+}
+
+func (pw *PriorityWriter) Write(p []byte) (n int, err error) {
+	return pw.tw.write(p, true)
+}
+
+func (tw *ThrottledWriter) write(p []byte, priority bool) (n int, err error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	now := time.Now()
+	if now.Sub(tw.windowStart) >= time.Second {
+		tw.windowStart = now
+		tw.lines = 0
+	}
+	tw.lines++
+	if tw.lines > tw.maxLines && !priority {
+		tw.dropped++
+		return len(p), nil
+	}
+	if tw.dropped > 0 {
+		fmt.Fprintf(tw.w, "%s ... %d lines dropped\n", now.Format("2006/01/02 15:04:05.000000"), tw.dropped)
+		tw.dropped = 0
+	}
+	return tw.w.Write(p)
+}
+
+// isScanFrequency returns true if the frequency is one of the frequencies
+// of the scan
+func isScanFrequency(scan *Scan, freq uint64) bool {
+	done := make(chan struct{})
+	defer close(done)
+	for freqAndIdx := range getScanFrequenciesAndIndexes(scan, done) {
+		if freqAndIdx.frequency == freq {
+			return true
+		}
+	}
+	return false
 }
 
 // generators
-func getScanFrequenciesAndIndexes(scan *Scan) (ch chan FrequencyAndIndex) {
+// the generators stop and close their channel as soon as the done channel
+// is closed, so callers can return early without leaking goroutines
+func getScanFrequenciesAndIndexes(scan *Scan, done <-chan struct{}) (ch chan FrequencyAndIndex) {
 	ch = make(chan FrequencyAndIndex)
 	go func() {
+		defer close(ch)
+		var index int
+		var seen map[uint64]bool
+		if scan.DedupFrequencies {
+			seen = make(map[uint64]bool)
+		}
+		send := func(frequency uint64) bool {
+			listenTime := scan.ListenTime
+			if t, ok := scan.ListenTimes[frequency]; ok {
+				listenTime = t
+			}
+			frequency = snapFrequency(frequency, scan.Snap)
+			if seen != nil {
+				if seen[frequency] {
+					return true
+				}
+				seen[frequency] = true
+			}
+			select {
+			case ch <- FrequencyAndIndex{frequency: frequency, index: index, listenTime: listenTime}:
+				index++
+				return true
+			case <-done:
+				return false
+			}
+		}
 		if scan.Step > 0 {
 			step := uint64(scan.Step)
-			var index int
 			for frequency := scan.Start; frequency <= scan.Stop; frequency += step {
-				ch <- FrequencyAndIndex{
-					frequency: frequency,
-					index:     index,
+				if !send(frequency) {
+					return
 				}
-				index++
 			}
-			close(ch)
 		} else if scan.Step < 0 {
 			step := uint64(-scan.Step)
-			var index int
 			for frequency := scan.Start; frequency >= scan.Stop; frequency -= step {
-				ch <- FrequencyAndIndex{
-					frequency: frequency,
-					index:     index,
+				if !send(frequency) {
+					return
 				}
-				index++
 			}
-			close(ch)
 		} else if len(scan.List) > 0 {
-			for index, frequency := range scan.List {
-				ch <- FrequencyAndIndex{
-					frequency: frequency,
-					index:     index,
+			list := scan.List
+			switch scan.Order {
+			case "asc":
+				list = slices.Sorted(slices.Values(scan.List))
+			case "desc":
+				list = slices.Sorted(slices.Values(scan.List))
+				slices.Reverse(list)
+			}
+			for _, frequency := range list {
+				if !send(frequency) {
+					return
 				}
 			}
-			close(ch)
 		} else {
-			log.Println("invalid scan: no range and no list")
-			close(ch)
+			priorityLog.Println("invalid scan: no range and no list")
 		}
 	}()
 	return ch
 }
 
-func getScanFrequenciesAndLOFrequencies(scan *Scan) (ch chan FrequencyAndLOFrequency) {
+func getScanFrequenciesAndLOFrequencies(scan *Scan, done <-chan struct{}) (ch chan FrequencyAndLOFrequency) {
 	ch = make(chan FrequencyAndLOFrequency)
 	go func() {
+		defer close(ch)
+		// the LO spans might be recomputed while the generator runs
+		loSpans := scan.LOSpans
 		var loIdx int
-		nextLOIdx := scan.LOSpans[loIdx].from
-		for freqAndIdx := range getScanFrequenciesAndIndexes(scan) {
+		nextLOIdx := loSpans[loIdx].from
+		// center hold: the current center frequency is kept as long as
+		// it can serve the frequencies, even past the start of a new span
+		var spanLOFrequency uint64
+		var currentLOFrequency uint64
+		for freqAndIdx := range getScanFrequenciesAndIndexes(scan, done) {
 			freq := freqAndIdx.frequency
 			idx := freqAndIdx.index
 			var loFrequency uint64
-			if idx == nextLOIdx {
-				loFrequency = scan.LOSpans[loIdx].frequency
+			spanStart := idx == nextLOIdx
+			if spanStart {
+				spanLOFrequency = loSpans[loIdx].frequency
 				loIdx++
-				if loIdx < len(scan.LOSpans) {
-					nextLOIdx = scan.LOSpans[loIdx].from
+				if loIdx < len(loSpans) {
+					nextLOIdx = loSpans[loIdx].from
 				} else {
 					nextLOIdx = -1
 				}
 			}
-			ch <- FrequencyAndLOFrequency{
+			if !scan.CenterHold {
+				if spanStart {
+					loFrequency = spanLOFrequency
+				}
+			} else if currentLOFrequency == 0 || !isServedByLOFrequency(scan, freq, currentLOFrequency) {
+				loFrequency = spanLOFrequency
+				currentLOFrequency = spanLOFrequency
+			}
+			select {
+			case ch <- FrequencyAndLOFrequency{
 				frequency:   freq,
 				loFrequency: loFrequency,
+				listenTime:  freqAndIdx.listenTime,
+				spanStart:   spanStart,
+			}:
+			case <-done:
+				return
 			}
 		}
-		close(ch)
 	}()
 	return ch
 }
@@ -0,0 +1,660 @@
+// scanner using SDRconnect - tests
+//
+// Copyright 2026 Franco Venturi.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"math"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// a scan with a short aging time doesn't age out the detections of a
+// scan with a longer one
+func TestTrackDetectionAgingPerScan(t *testing.T) {
+	clear(trackedDetections)
+	trackDetection(100e6, time.Hour)
+	trackDetection(200e6, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if !trackDetection(200e6, time.Millisecond) {
+		t.Error("aged detection not reported as new")
+	}
+	if trackDetection(100e6, time.Hour) {
+		t.Error("detection aged out with the aging time of another scan")
+	}
+}
+
+// waitForGoroutines waits until the number of goroutines is back to
+// the expected value (the generator goroutines exit asynchronously)
+func waitForGoroutines(t *testing.T, expected int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutine leak: %d goroutines, expected %d", runtime.NumGoroutine(), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScanFrequencyGeneratorsStopEarly(t *testing.T) {
+	sdrconnectSettings = SDRconnectSettings{SampleRate: 2e6, FilterBandwidth: 10000}
+	scan := &Scan{Start: 100e6, Stop: 110e6, Step: 100e3}
+	scan.LOSpans = getLOSpans(scan)
+	baseline := runtime.NumGoroutine()
+
+	// an early return from the scan closes the done channel while the
+	// generators are still sending
+	done := make(chan struct{})
+	ch := getScanFrequenciesAndIndexes(scan, done)
+	<-ch
+	<-ch
+	close(done)
+	for range ch {
+	}
+	waitForGoroutines(t, baseline)
+
+	// the LO frequency generator also runs the frequency generator
+	done = make(chan struct{})
+	loCh := getScanFrequenciesAndLOFrequencies(scan, done)
+	<-loCh
+	close(done)
+	for range loCh {
+	}
+	waitForGoroutines(t, baseline)
+}
+
+func TestGetSignalAverage(t *testing.T) {
+	// the first sample is ignored, and the average is in linear scale
+	average := getSignalAverage([]float64{0, -10, -20})
+	expected := 10 * math.Log10((0.1+0.01)/2)
+	if math.Abs(average-expected) > 1e-9 {
+		t.Errorf("average: %v, expected %v", average, expected)
+	}
+	if average > -10 {
+		t.Errorf("average %v higher than the peak", average)
+	}
+}
+
+func TestShowLineOutput(t *testing.T) {
+	var output bytes.Buffer
+	scan := &Scan{Name: "test", OutputWriter: csv.NewWriter(&output), OutputOnly: true}
+	showLine(scan, []string{"detect", "f=100000000", "pwr=-50.0dB", "snr=20.0dB"})
+	records, err := csv.NewReader(&output).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("records: %v - expected 1", records)
+	}
+	// time, scan, event, frequency, details
+	expected := []string{"test", "detect", "100000000", "pwr=-50.0dB snr=20.0dB"}
+	if !slices.Equal(records[0][1:], expected) {
+		t.Errorf("record %v - expected %v", records[0][1:], expected)
+	}
+}
+
+// writeConfigFile writes a configuration file in a temporary directory
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "scan.conf")
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+// the key bindings start from the defaults on every read
+func TestReadConfigFileKeyActions(t *testing.T) {
+	t.Cleanup(func() { keyActions = defaultKeyActions })
+	_, err := readConfigFile([]string{writeConfigFile(t, "key pause = p\n[scan]\nlist = 100000000\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyActions['p'] != "pause" || keyActions[' '] != "" {
+		t.Fatalf("pause key %s - expected 'p'", getActionKey("pause"))
+	}
+	_, err = readConfigFile([]string{writeConfigFile(t, "[scan]\nlist = 100000000\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyActions['p'] != "" || keyActions[' '] != "pause" {
+		t.Errorf("pause key %s - expected the default space", getActionKey("pause"))
+	}
+}
+
+// the spectrogram follows the changes of the scan frequencies
+func TestSpectrogramFrequenciesChange(t *testing.T) {
+	spectrogramDir = t.TempDir()
+	t.Cleanup(func() {
+		spectrogramDir = ""
+		clear(spectrograms)
+	})
+	scan := &Scan{Name: "refresh", List: []uint64{100e6, 101e6, 102e6}}
+	for _, freq := range scan.List {
+		addSpectrogramSample(scan, freq, -50)
+	}
+	if err := writeSpectrograms(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a list refresh adds 103 MHz and removes 100 MHz
+	scan.List = []uint64{101e6, 102e6, 103e6}
+	for _, freq := range scan.List {
+		addSpectrogramSample(scan, freq, -60)
+	}
+	spectrogram := spectrograms[scan]
+	if expected := []uint64{100e6, 101e6, 102e6, 103e6}; !slices.Equal(spectrogram.frequencies, expected) {
+		t.Fatalf("frequencies %v - expected %v", spectrogram.frequencies, expected)
+	}
+	if power := spectrogram.current[3]; power != -60 {
+		t.Errorf("sample for the new frequency %v - expected -60", power)
+	}
+	if err := writeSpectrograms(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the removed frequency is dropped once its samples are gone
+	spectrogramMaxRows = 1
+	t.Cleanup(func() { spectrogramMaxRows = 1000 })
+	addSpectrogramSample(scan, 101e6, -70)
+	if err := writeSpectrograms(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []uint64{101e6, 102e6, 103e6}; !slices.Equal(spectrogram.frequencies, expected) {
+		t.Errorf("frequencies %v - expected %v", spectrogram.frequencies, expected)
+	}
+}
+
+// an invalid configuration file doesn't change the global settings
+func TestReadConfigFileInvalidGlobalSettings(t *testing.T) {
+	t.Cleanup(func() {
+		keyActions = defaultKeyActions
+		cycleDelay = 0
+	})
+	_, err := readConfigFile([]string{writeConfigFile(t, "key pause = p\ncycle delay = 100\n[scan]\nlist = 100000000\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readConfigFile([]string{writeConfigFile(t, "key pause = x\ncycle delay = 500\n[scan]\nlist = 100000000\ndetect power mode = bogus\n")})
+	if err == nil {
+		t.Fatal("invalid configuration file not detected")
+	}
+	if keyActions['p'] != "pause" || keyActions['x'] != "" || cycleDelay != 100*time.Millisecond {
+		t.Errorf("invalid configuration partially applied: pause key %s - cycle delay %v", getActionKey("pause"), cycleDelay)
+	}
+}
+
+// with both detect absence and detection deltas a silent frequency is
+// reported only once, as 'gone'
+func TestDetectionDeltas(t *testing.T) {
+	var output bytes.Buffer
+	scan := &Scan{Name: "deltas", DetectAbsence: true, DetectionDeltas: true, OutputOnly: true}
+	scan.OutputWriter = csv.NewWriter(&output)
+	passes := []map[uint64]bool{
+		{100e6: true, 101e6: false},
+		{100e6: true, 101e6: true},
+		{100e6: false, 101e6: true},
+		{100e6: false},
+	}
+	expected := [][][]string{
+		{{"new", "100000000"}},
+		{{"still", "100000000"}, {"new", "101000000"}},
+		{{"gone", "100000000"}, {"still", "101000000"}},
+		nil,
+	}
+	for pass, active := range passes {
+		output.Reset()
+		for freq, detected := range active {
+			updateActiveState(scan, freq, detected)
+		}
+		showDetectionDeltas(scan)
+		records, err := csv.NewReader(&output).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var deltas [][]string
+		for _, record := range records {
+			// time, scan, event, frequency, details
+			deltas = append(deltas, record[2:4])
+		}
+		if !slices.EqualFunc(deltas, expected[pass], slices.Equal) {
+			t.Errorf("pass %d: deltas %v - expected %v", pass+1, deltas, expected[pass])
+		}
+	}
+}
+
+// the priority lines are written even when the low priority lines are dropped
+func TestThrottledWriterPriority(t *testing.T) {
+	var output bytes.Buffer
+	tw := &ThrottledWriter{w: &output, maxLines: 1}
+	pw := &PriorityWriter{tw: tw}
+	tw.Write([]byte("info 1\n"))
+	tw.Write([]byte("info 2\n"))
+	pw.Write([]byte("detect f=100000000\n"))
+	tw.Write([]byte("error: this is not a priority line\n"))
+	for _, line := range []string{"info 1\n", "detect f=100000000\n"} {
+		if !strings.Contains(output.String(), line) {
+			t.Errorf("line %q dropped", line)
+		}
+	}
+	for _, line := range []string{"info 2\n", "error: this is not a priority line\n"} {
+		if strings.Contains(output.String(), line) {
+			t.Errorf("line %q not dropped", line)
+		}
+	}
+}
+
+// the LO spans of an unsorted list must still serve every frequency
+func TestLOSpansShuffledList(t *testing.T) {
+	sdrconnectSettings = SDRconnectSettings{SampleRate: 2e6, FilterBandwidth: 10000}
+	var list []uint64
+	for freq := uint64(88e6); freq <= 108e6; freq += 200e3 {
+		list = append(list, freq)
+	}
+	random := rand.New(rand.NewSource(1))
+	for range 10 {
+		shuffled := slices.Clone(list)
+		random.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		scan := &Scan{Name: "shuffled", List: shuffled}
+		scan.LOSpans = getLOSpans(scan)
+		if err := checkLOSpans(scan); err != nil {
+			t.Fatal(err)
+		}
+
+		// same set of frequencies, each one served by its LO span
+		var scanned []uint64
+		var loFreq uint64
+		done := make(chan struct{})
+		for freqAndLOFreq := range getScanFrequenciesAndLOFrequencies(scan, done) {
+			if freqAndLOFreq.loFrequency != 0 {
+				loFreq = freqAndLOFreq.loFrequency
+			}
+			if !isServedByLOFrequency(scan, freqAndLOFreq.frequency, loFreq) {
+				t.Errorf("frequency %d not served by LO frequency %d", freqAndLOFreq.frequency, loFreq)
+			}
+			scanned = append(scanned, freqAndLOFreq.frequency)
+		}
+		close(done)
+		if !slices.Equal(slices.Sorted(slices.Values(scanned)), list) {
+			t.Errorf("scanned frequencies %v - expected %v", scanned, list)
+		}
+
+		// sorting the list gives fewer LO spans
+		scan.Order = "asc"
+		if sortedSpans := getLOSpans(scan); len(sortedSpans) > len(scan.LOSpans) {
+			t.Errorf("sorted list has %d LO spans - unsorted list %d", len(sortedSpans), len(scan.LOSpans))
+		}
+	}
+}
+
+// startFakeSdrconnect starts a fake SDRconnect WebSocket server that
+// answers each set_property with a property_changed after the given
+// latency, and connects to it
+func startFakeSdrconnect(tb testing.TB, latency time.Duration) {
+	tb.Helper()
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		var mu sync.Mutex
+		for {
+			var request Message
+			if err := websocket.JSON.Receive(conn, &request); err != nil {
+				return
+			}
+			if request.EventType != "set_property" {
+				continue
+			}
+			go func() {
+				time.Sleep(latency)
+				mu.Lock()
+				defer mu.Unlock()
+				websocket.JSON.Send(conn, Message{
+					EventType: "property_changed",
+					Property:  request.Property,
+					Value:     request.Value,
+				})
+			}()
+		}
+	}))
+	tb.Cleanup(server.Close)
+	if err := connectSdrconnect(strings.TrimPrefix(server.URL, "http://")); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ws.Close() })
+}
+
+func TestRunGetSetPropertyInvalidSet(t *testing.T) {
+	// the argument is checked before connecting to SDRconnect
+	if err := runGetSetProperty("", "", "agc_enable"); err == nil {
+		t.Error("invalid -set argument not detected")
+	}
+}
+
+var benchmarkProperties = []PropertyValue{
+	{"demodulator", "NFM"},
+	{"filter_bandwidth", "12500"},
+	{"squelch_enable", "true"},
+	{"squelch_threshold", "-90"},
+	{"agc_enable", "false"},
+}
+
+// per-scan setup latency when the scan properties are set one at a time
+func BenchmarkSetSdrconnectPropertySequential(b *testing.B) {
+	startFakeSdrconnect(b, time.Millisecond)
+	for b.Loop() {
+		for _, property := range benchmarkProperties {
+			if _, _, err := setSdrconnectProperty(property.property, property.value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// per-scan setup latency when the scan properties are set in a batch
+func BenchmarkSetSdrconnectPropertiesBatched(b *testing.B) {
+	startFakeSdrconnect(b, time.Millisecond)
+	for b.Loop() {
+		if _, err := setSdrconnectProperties(benchmarkProperties); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScanFrequenciesAndLOFrequencies(b *testing.B) {
+	sdrconnectSettings = SDRconnectSettings{SampleRate: 2e6, FilterBandwidth: 10000}
+	scan := &Scan{Start: 88e6, Stop: 108e6, Step: 100e3}
+	scan.LOSpans = getLOSpans(scan)
+	for b.Loop() {
+		done := make(chan struct{})
+		for range getScanFrequenciesAndLOFrequencies(scan, done) {
+		}
+		close(done)
+	}
+}
+
+func TestIsScanFrequency(t *testing.T) {
+	scan := &Scan{Name: "test", Start: 100e6, Stop: 101e6, Step: 100e3}
+	baseline := runtime.NumGoroutine()
+	if !isScanFrequency(scan, 100.2e6) {
+		t.Error("scan frequency not found")
+	}
+	if isScanFrequency(scan, 100.25e6) {
+		t.Error("frequency not in the scan found")
+	}
+	waitForGoroutines(t, baseline)
+}
+
+func TestCheckLOSpans(t *testing.T) {
+	// 1536 kHz IF bandwidth - 10 kHz filter bandwidth
+	sdrconnectSettings = SDRconnectSettings{SampleRate: 2e6, FilterBandwidth: 10000}
+	list := []uint64{100.0e6, 100.1e6, 100.2e6, 103.0e6, 103.1e6}
+	tests := []struct {
+		name    string
+		loSpans []LOSpan
+		valid   bool
+	}{
+		{"computed", getLOSpans(&Scan{List: list}), true},
+		{"one span per frequency", []LOSpan{{0, 0, 100.0e6}, {1, 1, 100.1e6}, {2, 2, 100.2e6}, {3, 3, 103.0e6}, {4, 4, 103.1e6}}, true},
+		{"gap", []LOSpan{{0, 1, 100.05e6}, {3, 4, 103.05e6}}, false},
+		{"overlap", []LOSpan{{0, 2, 100.1e6}, {2, 4, 103.05e6}}, false},
+		{"inverted", []LOSpan{{0, 2, 100.1e6}, {4, 3, 103.05e6}}, false},
+		{"missing last frequencies", []LOSpan{{0, 2, 100.1e6}}, false},
+		{"past last frequency", []LOSpan{{0, 2, 100.1e6}, {3, 5, 103.05e6}}, false},
+		{"frequency outside of passband", []LOSpan{{0, 4, 101.55e6}}, false},
+		{"no spans", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scan := &Scan{List: list, LOSpans: test.loSpans}
+			err := checkLOSpans(scan)
+			if test.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("invalid LO spans %v not detected", test.loSpans)
+			}
+		})
+	}
+}
+
+func TestGetActionKey(t *testing.T) {
+	for action, expected := range map[string]string{"pause": "space", "next": "'n'", "forward": "'f'", "unknown": "(no key)"} {
+		if key := getActionKey(action); key != expected {
+			t.Errorf("key for %s: %s - expected %s", action, key, expected)
+		}
+	}
+}
+
+func TestAnalyzeCWKeying(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		wpm      int
+	}{
+		{"20 wpm", 60 * time.Millisecond, 20},
+		{"sub-millisecond elements", 100 * time.Microsecond, 0},
+		{"same timestamp", 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearReceiveStats()
+			start := time.Now()
+			// the first sample is ignored, then dits and spaces
+			for idx, power := range []float64{-60, -60, -100, -60, -100, -60, -100, -60, -100} {
+				receiveStats.signalPower = append(receiveStats.signalPower, power)
+				receiveStats.signalPowerTime = append(receiveStats.signalPowerTime, start.Add(time.Duration(idx)*test.interval))
+			}
+			keying, wpm := analyzeCWKeying()
+			if !keying {
+				t.Fatal("keying not detected")
+			}
+			if wpm != test.wpm {
+				t.Errorf("wpm %d - expected %d", wpm, test.wpm)
+			}
+		})
+	}
+}
+
+// the detection is confirmed with the detect criteria, using only the
+// stats collected while listening
+func TestConfirmSignal(t *testing.T) {
+	scan := &Scan{DetectPowerThreshold: -70, DetectSNRThreshold: 10}
+	clearReceiveStats()
+	// detect time, then listen time
+	receiveStats.signalPower = []float64{-50, -50, -50, -90, -90, -90}
+	receiveStats.signalSNR = []float64{20, 20, 20, 1, 1, 1}
+	if confirmSignal(scan, 3, 3, time.Second) {
+		t.Error("signal gone while listening confirmed")
+	}
+	receiveStats.signalPower = []float64{-50, -50, -50, -90, -60, -60}
+	if !confirmSignal(scan, 3, 3, time.Second) {
+		t.Error("signal still present while listening not confirmed")
+	}
+	// no signal power and SNR streamed while listening
+	scan.DetectFallback = "always"
+	if !confirmSignal(scan, 6, 6, time.Second) {
+		t.Error("detect fallback not used to confirm the signal")
+	}
+}
+
+// the probe offsets of the fine search stay within the IF bandwidth
+func TestLOSpansFineSearch(t *testing.T) {
+	sdrconnectSettings = SDRconnectSettings{SampleRate: 2e6, FilterBandwidth: 10000}
+	scan := &Scan{Start: 100e6, Stop: 110e6, Step: 100e3, FineSearch: 50000}
+	scan.LOSpans = getLOSpans(scan)
+	maxOffset := int64(getIFBandwidth(scan, sdrconnectSettings.SampleRate)-sdrconnectSettings.FilterBandwidth) / 2
+	done := make(chan struct{})
+	defer close(done)
+	for freqAndIdx := range getScanFrequenciesAndIndexes(scan, done) {
+		for _, loSpan := range scan.LOSpans {
+			if freqAndIdx.index < loSpan.from || freqAndIdx.index > loSpan.to {
+				continue
+			}
+			offset := int64(freqAndIdx.frequency) - int64(loSpan.frequency)
+			if max(offset, -offset)+int64(scan.FineSearch) > maxOffset {
+				t.Errorf("fine search around %d outside of the IF of LO %d", freqAndIdx.frequency, loSpan.frequency)
+			}
+		}
+	}
+}
+
+func TestGetSdrconnectSettingLeftUnset(t *testing.T) {
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		for {
+			var request Message
+			if err := websocket.JSON.Receive(conn, &request); err != nil {
+				return
+			}
+			response := Message{EventType: "get_property_response", Property: request.Property}
+			switch request.Property {
+			case "rejected":
+				response.EventType = "error"
+				response.Value = "unknown property"
+			case "unparseable":
+				response.Value = ""
+			case "valid":
+				response.Value = "true"
+			}
+			websocket.JSON.Send(conn, response)
+		}
+	}))
+	defer server.Close()
+	if err := connectSdrconnect(strings.TrimPrefix(server.URL, "http://")); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	savedWaitGetProperty := waitGetProperty
+	waitGetProperty = 10 * time.Millisecond
+	defer func() { waitGetProperty = savedWaitGetProperty }()
+
+	for _, property := range []string{"rejected", "unparseable", "valid"} {
+		var value bool
+		err := getSdrconnectSetting(property, func(v string) (err error) {
+			value, err = strconv.ParseBool(v)
+			return
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", property, err)
+		}
+		if value != (property == "valid") {
+			t.Errorf("%s: value = %v", property, value)
+		}
+	}
+}
+
+func TestIsServedByLOFrequency(t *testing.T) {
+	// 1536 kHz IF bandwidth - 10 kHz filter bandwidth
+	sdrconnectSettings = SDRconnectSettings{SampleRate: 2e6, FilterBandwidth: 10000}
+	tests := []struct {
+		frequency uint64
+		loOffset  int32
+		served    bool
+	}{
+		{100.0e6, 0, true},
+		{100.763e6, 0, true},
+		{100.764e6, 0, false},
+		{99.237e6, 0, true},
+		// the LO offset also narrows the range served
+		{100.713e6, 100e3, true},
+		{100.714e6, 100e3, false},
+		{99.287e6, 100e3, true},
+	}
+	for _, test := range tests {
+		scan := &Scan{LOOffset: test.loOffset}
+		if served := isServedByLOFrequency(scan, test.frequency, 100e6+uint64(test.loOffset)); served != test.served {
+			t.Errorf("%d (LO offset %d): served = %v", test.frequency, test.loOffset, served)
+		}
+	}
+}
+
+func TestDetectSignalTrigger(t *testing.T) {
+	scan := &Scan{DetectPowerThreshold: -70, DetectSNRThreshold: 10}
+	tests := []struct {
+		signalPower []float64
+		signalSNR   []float64
+		trigger     string
+	}{
+		{[]float64{-90, -90}, []float64{1, 1}, ""},
+		{[]float64{-90, -60}, []float64{1, 1}, "power"},
+		{[]float64{-90, -90}, []float64{1, 20}, "snr"},
+		{[]float64{-90, -60}, []float64{1, 20}, "power+snr"},
+	}
+	for _, test := range tests {
+		clearReceiveStats()
+		receiveStats.signalPower = test.signalPower
+		receiveStats.signalSNR = test.signalSNR
+		signalDetected, trigger := detectSignal(scan)
+		if signalDetected != (test.trigger != "") || trigger != test.trigger {
+			t.Errorf("%v %v: detected = %v trigger = %q", test.signalPower, test.signalSNR, signalDetected, trigger)
+		}
+	}
+	// no signal power and SNR streamed
+	clearReceiveStats()
+	scan.DetectFallback = "always"
+	if _, trigger := detectSignal(scan); trigger != "always" {
+		t.Errorf("detect fallback trigger = %q", trigger)
+	}
+}
+
+func TestFormatFrequency(t *testing.T) {
+	tests := []struct {
+		displayUnit      string
+		displayPrecision int
+		frequency        uint64
+		formatted        string
+	}{
+		{"", -1, 7074000, "7074000"},
+		{"hz", -1, 7074000, "7074000"},
+		{"khz", -1, 7074000, "7074kHz"},
+		{"khz", -1, 7074500, "7074.5kHz"},
+		{"mhz", -1, 145500000, "145.5MHz"},
+		{"khz", 1, 7074000, "7074.0kHz"},
+		{"mhz", 3, 145512500, "145.512MHz"},
+		{"hz", 1, 7074000, "7074000.0"},
+	}
+	for _, test := range tests {
+		scan := &Scan{DisplayUnit: test.displayUnit, DisplayPrecision: test.displayPrecision}
+		if formatted := formatFrequency(scan, test.frequency); formatted != test.formatted {
+			t.Errorf("%d %s %d: formatted = %s", test.frequency, test.displayUnit, test.displayPrecision, formatted)
+		}
+	}
+}
+
+func TestParseJumpFrequency(t *testing.T) {
+	tests := []struct {
+		entry     string
+		frequency uint64
+		valid     bool
+	}{
+		{"7074000", 7074000, true},
+		{"7074k", 7074000, true},
+		{"7074.5K", 7074500, true},
+		{"145.5M", 145500000, true},
+		{"0", 0, false},
+		{"k", 0, false},
+		{"1.2.3", 0, false},
+	}
+	for _, test := range tests {
+		frequency, err := parseJumpFrequency(test.entry)
+		if (err == nil) != test.valid || frequency != test.frequency {
+			t.Errorf("%s: frequency = %d err = %v", test.entry, frequency, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// scanner using SDRconnect - spectrogram
+//
+// Copyright 2026 Franco Venturi.
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+)
+
+// each scan has its own spectrogram with the scan frequencies on the
+// x axis and one row per cycle on the y axis (the most recent at the
+// bottom, like a waterfall)
+type Spectrogram struct {
+	frequencies []uint64
+	index       map[uint64]int
+	rows        [][]float64
+	current     []float64
+}
+
+var spectrogramDir string
+var spectrograms = make(map[*Scan]*Spectrogram)
+
+// size of the spectrogram images
+var spectrogramMaxRows = 1000
+var spectrogramMinWidth = 800
+var spectrogramRowHeight = 4
+
+// addSpectrogramSample records the signal power measured on a frequency
+// during the current cycle
+func addSpectrogramSample(scan *Scan, freq uint64, power float64) {
+	spectrogram, ok := spectrograms[scan]
+	if !ok {
+		spectrogram = newSpectrogram(scan)
+		spectrograms[scan] = spectrogram
+	}
+	idx, ok := spectrogram.index[freq]
+	if !ok {
+		// the scan frequencies changed (e.g. with 'list command refresh')
+		updateSpectrogramFrequencies(spectrogram, scan)
+		idx, ok = spectrogram.index[freq]
+		if !ok {
+			return
+		}
+	}
+	if spectrogram.current == nil {
+		spectrogram.current = newSpectrogramRow(len(spectrogram.frequencies))
+	}
+	// max returns NaN if any of its arguments is NaN
+	if math.IsNaN(spectrogram.current[idx]) {
+		spectrogram.current[idx] = power
+	} else {
+		spectrogram.current[idx] = max(spectrogram.current[idx], power)
+	}
+}
+
+func newSpectrogram(scan *Scan) (spectrogram *Spectrogram) {
+	spectrogram = &Spectrogram{index: make(map[uint64]int)}
+	spectrogram.frequencies = getSpectrogramFrequencies(scan)
+	for idx, freq := range spectrogram.frequencies {
+		spectrogram.index[freq] = idx
+	}
+	return
+}
+
+// getSpectrogramFrequencies returns the scan frequencies in ascending order
+func getSpectrogramFrequencies(scan *Scan) (frequencies []uint64) {
+	done := make(chan struct{})
+	for freqAndIdx := range getScanFrequenciesAndIndexes(scan, done) {
+		frequencies = append(frequencies, freqAndIdx.frequency)
+	}
+	close(done)
+	slices.Sort(frequencies)
+	frequencies = slices.Compact(frequencies)
+	return
+}
+
+// updateSpectrogramFrequencies rebuilds the x axis when the scan
+// frequencies change; the frequencies removed from the scan are kept
+// only as long as the spectrogram rows have samples for them
+func updateSpectrogramFrequencies(spectrogram *Spectrogram, scan *Scan) {
+	frequencies := getSpectrogramFrequencies(scan)
+	for idx, freq := range spectrogram.frequencies {
+		if slices.ContainsFunc(spectrogram.rows, func(row []float64) bool { return !math.IsNaN(row[idx]) }) ||
+			(spectrogram.current != nil && !math.IsNaN(spectrogram.current[idx])) {
+			frequencies = append(frequencies, freq)
+		}
+	}
+	slices.Sort(frequencies)
+	frequencies = slices.Compact(frequencies)
+	if slices.Equal(frequencies, spectrogram.frequencies) {
+		return
+	}
+	index := make(map[uint64]int)
+	for idx, freq := range frequencies {
+		index[freq] = idx
+	}
+	remap := func(row []float64) (newRow []float64) {
+		newRow = newSpectrogramRow(len(frequencies))
+		for idx, freq := range spectrogram.frequencies {
+			if newIdx, ok := index[freq]; ok {
+				newRow[newIdx] = row[idx]
+			}
+		}
+		return
+	}
+	for idx, row := range spectrogram.rows {
+		spectrogram.rows[idx] = remap(row)
+	}
+	if spectrogram.current != nil {
+		spectrogram.current = remap(spectrogram.current)
+	}
+	spectrogram.frequencies = frequencies
+	spectrogram.index = index
+}
+
+// frequencies not measured in a cycle are NaN
+func newSpectrogramRow(size int) (row []float64) {
+	row = make([]float64, size)
+	for idx := range row {
+		row[idx] = math.NaN()
+	}
+	return
+}
+
+// writeSpectrograms closes the current cycle row of each spectrogram and
+// writes the spectrogram images (one PNG file per scan)
+func writeSpectrograms() (err error) {
+	for scan, spectrogram := range spectrograms {
+		if spectrogram.current == nil {
+			continue
+		}
+		spectrogram.rows = append(spectrogram.rows, spectrogram.current)
+		spectrogram.current = nil
+		if len(spectrogram.rows) > spectrogramMaxRows {
+			spectrogram.rows = spectrogram.rows[len(spectrogram.rows)-spectrogramMaxRows:]
+		}
+		updateSpectrogramFrequencies(spectrogram, scan)
+		err = writeSpectrogramImage(spectrogram, getSpectrogramFile(scan))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func getSpectrogramFile(scan *Scan) string {
+	return filepath.Join(spectrogramDir, unsafeFileNameChars.ReplaceAllString(scan.Name, "_")+".png")
+}
+
+func writeSpectrogramImage(spectrogram *Spectrogram, spectrogramFile string) (err error) {
+	// the colors are scaled between the min and max power
+	minPower := math.Inf(1)
+	maxPower := math.Inf(-1)
+	for _, row := range spectrogram.rows {
+		for _, power := range row {
+			if !math.IsNaN(power) {
+				minPower = min(minPower, power)
+				maxPower = max(maxPower, power)
+			}
+		}
+	}
+
+	cellWidth := max(1, spectrogramMinWidth/len(spectrogram.frequencies))
+	width := cellWidth * len(spectrogram.frequencies)
+	height := spectrogramRowHeight * len(spectrogram.rows)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, row := range spectrogram.rows {
+		for x, power := range row {
+			c := color.RGBA{A: 255}
+			if !math.IsNaN(power) {
+				level := 0.0
+				if maxPower > minPower {
+					level = (power - minPower) / (maxPower - minPower)
+				}
+				c = getSpectrogramColor(level)
+			}
+			for dy := range spectrogramRowHeight {
+				for dx := range cellWidth {
+					img.SetRGBA(x*cellWidth+dx, y*spectrogramRowHeight+dy, c)
+				}
+			}
+		}
+	}
+
+	var file *os.File
+	file, err = os.Create(spectrogramFile)
+	if err != nil {
+		return
+	}
+	// a failed write might only be reported when the file is closed
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	err = png.Encode(file, img)
+	return
+}
+
+// getSpectrogramColor maps a level between 0 and 1 to the usual waterfall
+// colors: dark blue, blue, yellow, red
+func getSpectrogramColor(level float64) color.RGBA {
+	palette := []color.RGBA{
+		{0, 0, 48, 255},
+		{0, 0, 255, 255},
+		{255, 255, 0, 255},
+		{255, 0, 0, 255},
+	}
+	level = min(max(level, 0), 1) * float64(len(palette)-1)
+	idx := min(int(level), len(palette)-2)
+	t := level - float64(idx)
+	from := palette[idx]
+	to := palette[idx+1]
+	mix := func(a, b uint8) uint8 {
+		return uint8(float64(a) + t*(float64(b)-float64(a)))
+	}
+	return color.RGBA{mix(from.R, to.R), mix(from.G, to.G), mix(from.B, to.B), 255}
+}